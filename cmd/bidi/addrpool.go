@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// addrPool is a set of local source addresses of a single IP version that
+// probes can be sent from. Addresses are given as a list of IPs and / or CIDR
+// ranges (e.g. "192.0.2.10,192.0.2.16/29" or "2001:db8:1::/64") so that large
+// ranges like an IPv6 /64 never need to be enumerated.
+//
+// Each probe is assigned a source address either per target, where all
+// probes to a given target are sent from the same address, or per probe, where
+// addresses are assigned round robin.
+type addrPool struct {
+	prefixes []*net.IPNet
+
+	// next is the round robin counter used for per probe assignment.
+	next uint64
+}
+
+// newAddrPool builds a pool from the comma separated list of addresses in
+// spec. Entries that are not the same IP version as probe are ignored. If no
+// suitable entries remain the preferred source address for the interface is
+// used (see getSrcIP).
+func newAddrPool(localIface *net.Interface, spec string, probe net.IP) (*addrPool, error) {
+	useV4 := probe.To4() != nil
+
+	p := &addrPool{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var prefix *net.IPNet
+		if strings.Contains(entry, "/") {
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("bad local address range \"%s\": %s", entry, err)
+			}
+			prefix = n
+		} else {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("bad local address \"%s\"", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			prefix = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+
+		if (prefix.IP.To4() != nil) != useV4 {
+			continue
+		}
+		p.prefixes = append(p.prefixes, prefix)
+	}
+
+	// Check that there is a route using the first address of the pool, or
+	// adopt the preferred source if no suitable address was specified.
+	var first string
+	if len(p.prefixes) > 0 {
+		first = p.pick(nil, true).String()
+		p.next = 0
+	}
+	src, err := getSrcIP(localIface, first, probe)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.prefixes) == 0 {
+		if useV4 {
+			src = src.To4()
+		}
+		bits := len(src) * 8
+		p.prefixes = append(p.prefixes, &net.IPNet{IP: src, Mask: net.CIDRMask(bits, bits)})
+	}
+
+	return p, nil
+}
+
+// pick selects the source address to use for a probe to target.
+func (p *addrPool) pick(target net.IP, perProbe bool) net.IP {
+	var key uint64
+	if perProbe {
+		key = atomic.AddUint64(&p.next, 1) - 1
+	} else {
+		h := fnv.New64a()
+		h.Write(target.To16())
+		key = h.Sum64()
+	}
+
+	prefix := p.prefixes[key%uint64(len(p.prefixes))]
+	key /= uint64(len(p.prefixes))
+
+	ones, bits := prefix.Mask.Size()
+	hostBits := bits - ones
+
+	var offset uint64
+	switch {
+	case hostBits == 0:
+		return prefix.IP
+	case hostBits == 1:
+		// point-to-point /31 and /127 prefixes have no network or broadcast
+		// address, both are hosts (RFC 3021, RFC 6164)
+		offset = key % 2
+	case bits == 32 && hostBits >= 2:
+		// skip the network and broadcast addresses
+		offset = 1 + key%((1<<hostBits)-2)
+	case hostBits < 64:
+		// skip the network (subnet-router anycast) address
+		offset = 1 + key%((1<<hostBits)-1)
+	default:
+		offset = key
+		if offset == 0 {
+			offset = 1
+		}
+	}
+
+	ip := make(net.IP, len(prefix.IP))
+	copy(ip, prefix.IP)
+	if len(ip) == net.IPv4len {
+		binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(ip)+uint32(offset))
+		return ip
+	}
+	low := ip[len(ip)-8:]
+	binary.BigEndian.PutUint64(low, binary.BigEndian.Uint64(low)+offset)
+	return ip
+}
+
+func (p *addrPool) String() string {
+	if p == nil {
+		return "none"
+	}
+	var s []string
+	for _, prefix := range p.prefixes {
+		s = append(s, prefix.String())
+	}
+	return strings.Join(s, ",")
+}
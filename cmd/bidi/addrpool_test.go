@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddrPoolPick(t *testing.T) {
+	localIface, err := net.InterfaceByName("lo")
+	require.Nil(t, err)
+
+	p, err := newAddrPool(localIface, "127.0.0.1,127.0.1.0/30,::1", net.ParseIP("127.0.0.1"))
+	require.Nil(t, err)
+	require.Equal(t, "127.0.0.1/32,127.0.1.0/30", p.String())
+
+	// per probe assignment cycles through the prefixes, skipping network and
+	// broadcast addresses in ranges.
+	seen := map[string]int{}
+	for i := 0; i < 8; i++ {
+		seen[p.pick(nil, true).String()]++
+	}
+	require.Equal(t, map[string]int{"127.0.0.1": 4, "127.0.1.1": 2, "127.0.1.2": 2}, seen)
+
+	// per target assignment is stable for a target
+	target := net.ParseIP("192.0.2.1")
+	first := p.pick(target, false)
+	for i := 0; i < 4; i++ {
+		require.Equal(t, first, p.pick(target, false))
+	}
+}
+
+func TestAddrPoolPointToPoint(t *testing.T) {
+	localIface, err := net.InterfaceByName("lo")
+	require.Nil(t, err)
+
+	// both addresses of /31 and /127 prefixes are used
+	for _, tc := range []struct {
+		spec  string
+		probe string
+		addrs []string
+	}{
+		{"127.0.1.0/31", "127.0.0.1", []string{"127.0.1.0", "127.0.1.1"}},
+		{"2001:db8:1::/127", "::1", []string{"2001:db8:1::", "2001:db8:1::1"}},
+	} {
+		p, err := newAddrPool(localIface, tc.spec, net.ParseIP(tc.probe))
+		require.Nil(t, err, tc.spec)
+
+		seen := map[string]int{}
+		for i := 0; i < 4; i++ {
+			seen[p.pick(nil, true).String()]++
+		}
+		require.Equal(t, map[string]int{tc.addrs[0]: 2, tc.addrs[1]: 2}, seen, tc.spec)
+	}
+}
+
+func TestAddrPoolIPv6Prefix(t *testing.T) {
+	localIface, err := net.InterfaceByName("lo")
+	require.Nil(t, err)
+
+	p, err := newAddrPool(localIface, "2001:db8:1::/64", net.ParseIP("::1"))
+	require.Nil(t, err)
+
+	_, prefix, _ := net.ParseCIDR("2001:db8:1::/64")
+	for i := 0; i < 16; i++ {
+		ip := p.pick(net.ParseIP("192.0.2.1").To16(), false)
+		require.True(t, prefix.Contains(ip))
+		ip = p.pick(nil, true)
+		require.True(t, prefix.Contains(ip))
+		require.NotEqual(t, "2001:db8:1::", ip.String())
+	}
+
+	// the wrong ip version falls back to the preferred source address
+	p, err = newAddrPool(localIface, "2001:db8:1::/64", net.ParseIP("127.0.0.1"))
+	require.Nil(t, err)
+	require.Equal(t, "127.0.0.1", p.pick(nil, true).String())
+
+	_, err = newAddrPool(localIface, "not-an-ip", net.ParseIP("127.0.0.1"))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// captureOpts selects the backend used by capturePcap to capture responses.
+var captureOpts = captureOptions{backend: "pcap"}
+
+type captureOptions struct {
+	// backend is one of pcap (libpcap) or afpacket (TPACKET_V3 ring).
+	backend string
+
+	// ringMB is the size of the ring buffer of each afpacket socket in MB.
+	ringMB int
+
+	// fanout is the number of afpacket sockets (and reader goroutines) that
+	// packets are load balanced across.
+	fanout int
+}
+
+const (
+	afpacketFrameSize = 1 << 11
+	afpacketBlockSize = 1 << 20
+	afpacketSnaplen   = 1600
+	afpacketPoll      = 100 * time.Millisecond
+)
+
+// captureStats collects the kernel packet counters of the open capture
+// handles for the periodic stats log line.
+var captureStats = &captureCounters{}
+
+// captureCounts are the kernel packet counters of a capture handle.
+type captureCounts struct {
+	received uint64
+	// dropped for lack of buffer space
+	dropped uint64
+	// dropped by the interface / driver
+	ifDropped uint64
+}
+
+// captureCounterFunc returns the counters of a capture handle since it was
+// opened.
+type captureCounterFunc func() (captureCounts, error)
+
+type captureCounters struct {
+	sources map[int]captureCounterFunc
+	nextID  int
+
+	// closed is the sum of the final counters of closed handles
+	closed captureCounts
+
+	mu sync.Mutex
+}
+
+// register adds the counters of a capture handle. The returned func must be
+// called before the handle is closed - it records the final counters of the
+// handle and stops querying it, so the handle is never queried after close.
+func (c *captureCounters) register(f captureCounterFunc) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sources == nil {
+		c.sources = make(map[int]captureCounterFunc)
+	}
+	id := c.nextID
+	c.nextID++
+	c.sources[id] = f
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		f, ok := c.sources[id]
+		if !ok {
+			return
+		}
+		if counts, err := f(); err == nil {
+			c.closed.add(counts)
+		}
+		delete(c.sources, id)
+	}
+}
+
+// totals returns the counters summed across all capture handles.
+func (c *captureCounters) totals() captureCounts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	total := c.closed
+	for _, f := range c.sources {
+		counts, err := f()
+		if err != nil {
+			continue
+		}
+		total.add(counts)
+	}
+	return total
+}
+
+func (c *captureCounts) add(o captureCounts) {
+	c.received += o.received
+	c.dropped += o.dropped
+	c.ifDropped += o.ifDropped
+}
+
+// pcapCounters reports the libpcap statistics for a handle.
+func pcapCounters(handle *pcap.Handle) captureCounterFunc {
+	return func() (captureCounts, error) {
+		s, err := handle.Stats()
+		if err != nil {
+			return captureCounts{}, err
+		}
+		return captureCounts{
+			received:  uint64(s.PacketsReceived),
+			dropped:   uint64(s.PacketsDropped),
+			ifDropped: uint64(s.PacketsIfDropped),
+		}, nil
+	}
+}
+
+// afpacketCounters reports the PACKET_STATISTICS counters for a socket.
+// Interface drops are not reported by AF_PACKET sockets.
+func afpacketCounters(handle *afpacket.TPacket) captureCounterFunc {
+	return func() (captureCounts, error) {
+		_, s, err := handle.SocketStats()
+		if err != nil {
+			return captureCounts{}, err
+		}
+		return captureCounts{
+			received: uint64(s.Packets()),
+			dropped:  uint64(s.Drops()),
+		}, nil
+	}
+}
+
+// newAFPacketHandle opens a TPACKET_V3 socket on iface with the filter
+// applied, joined to the fanout group id if fanout is in use.
+func newAFPacketHandle(iface string, filter []bpf.RawInstruction, fanoutID uint16) (*afpacket.TPacket, error) {
+	numBlocks := captureOpts.ringMB * (1 << 20) / afpacketBlockSize
+	if numBlocks < 1 {
+		numBlocks = 1
+	}
+
+	handle, err := afpacket.NewTPacket(
+		afpacket.OptInterface(iface),
+		afpacket.OptFrameSize(afpacketFrameSize),
+		afpacket.OptBlockSize(afpacketBlockSize),
+		afpacket.OptNumBlocks(numBlocks),
+		afpacket.OptPollTimeout(afpacketPoll),
+		afpacket.TPacketVersion3)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open afpacket socket: %s", err)
+	}
+
+	if err := handle.SetBPF(filter); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("failed to set afpacket filter: %s", err)
+	}
+
+	if captureOpts.fanout > 1 {
+		if err := handle.SetFanout(afpacket.FanoutHash, fanoutID); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("failed to set afpacket fanout: %s", err)
+		}
+	}
+
+	return handle, nil
+}
+
+// compileFilter compiles a BPF filter expression for ethernet frames.
+func compileFilter(bpfFilter string, snaplen int) ([]bpf.RawInstruction, error) {
+	insns, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, snaplen, bpfFilter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile filter \"%s\": %s", bpfFilter, err)
+	}
+
+	raw := make([]bpf.RawInstruction, len(insns))
+	for i, ins := range insns {
+		raw[i] = bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return raw, nil
+}
+
+// captureAFPacket captures packets matching bpfFilter on iface into w using
+// captureOpts.fanout afpacket sockets until exit is closed. Captured packets
+// are counted in stats under name.
+func captureAFPacket(iface, name, bpfFilter string, w *rotatingPcapWriter, exit chan struct{}) error {
+	filter, err := compileFilter(bpfFilter, afpacketSnaplen)
+	if err != nil {
+		return err
+	}
+
+	nSockets := captureOpts.fanout
+	if nSockets < 1 {
+		nSockets = 1
+	}
+
+	// each capture in the process (e.g. for different probe types) uses its
+	// own fanout group.
+	fanoutID := uint16(time.Now().UnixNano())
+
+	var handles []*afpacket.TPacket
+	var unregister []func()
+	defer func() {
+		for _, f := range unregister {
+			f()
+		}
+		for _, handle := range handles {
+			handle.Close()
+		}
+	}()
+	for i := 0; i < nSockets; i++ {
+		handle, err := newAFPacketHandle(iface, filter, fanoutID)
+		if err != nil {
+			return err
+		}
+		handles = append(handles, handle)
+		unregister = append(unregister, captureStats.register(afpacketCounters(handle)))
+	}
+
+	var mu sync.Mutex
+	var readers sync.WaitGroup
+	for _, handle := range handles {
+		readers.Add(1)
+		go func(handle *afpacket.TPacket) {
+			defer readers.Done()
+			for {
+				select {
+				case <-exit:
+					return
+				default:
+				}
+
+				data, ci, err := handle.ReadPacketData()
+				if err == afpacket.ErrTimeout || err == afpacket.ErrPoll {
+					continue
+				} else if err != nil {
+					log.Printf("afpacket ReadPacketData() error: %v", err)
+					return
+				}
+
+				mu.Lock()
+				err = w.WritePacket(ci, data)
+				mu.Unlock()
+				if err != nil {
+					log.Printf("pcap.WritePacket() error: %v", err)
+					return
+				}
+				stats.incReceived(name, classifyPacket(gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Lazy)))
+			}
+		}(handle)
+	}
+
+	readers.Wait()
+	log.Println("Closing pcap handler")
+	return nil
+}
+
+// classifyPacket classifies a captured response for the live result counts.
+// Classes are tcp_rst, tcp_fin, tcp_synack, tcp_data, tcp_other, udp, icmp, or
+// other.
+func classifyPacket(packet gopacket.Packet) string {
+	if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+		tcp, _ := tcpLayer.(*layers.TCP)
+		switch {
+		case tcp.RST:
+			return "tcp_rst"
+		case tcp.FIN:
+			return "tcp_fin"
+		case tcp.SYN && tcp.ACK:
+			return "tcp_synack"
+		case len(tcp.Payload) > 0:
+			return "tcp_data"
+		default:
+			return "tcp_other"
+		}
+	} else if packet.Layer(layers.LayerTypeUDP) != nil {
+		return "udp"
+	} else if packet.Layer(layers.LayerTypeICMPv4) != nil || packet.Layer(layers.LayerTypeICMPv6) != nil {
+		return "icmp"
+	}
+	return "other"
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureCounters(t *testing.T) {
+	c := &captureCounters{}
+	require.Equal(t, captureCounts{}, c.totals())
+
+	c.register(func() (captureCounts, error) { return captureCounts{100, 2, 1}, nil })
+	c.register(func() (captureCounts, error) { return captureCounts{50, 1, 0}, nil })
+	// closed handles are skipped
+	c.register(func() (captureCounts, error) { return captureCounts{7, 7, 7}, errors.New("closed") })
+
+	require.Equal(t, captureCounts{150, 3, 1}, c.totals())
+}
+
+func TestCaptureCountersUnregister(t *testing.T) {
+	c := &captureCounters{}
+
+	closed := false
+	counts := captureCounts{10, 1, 0}
+	unregister := c.register(func() (captureCounts, error) {
+		require.False(t, closed, "closed handle queried")
+		return counts, nil
+	})
+	c.register(func() (captureCounts, error) { return captureCounts{5, 0, 0}, nil })
+	require.Equal(t, captureCounts{15, 1, 0}, c.totals())
+
+	// the final counters are kept after the handle is unregistered and closed
+	counts = captureCounts{20, 2, 0}
+	unregister()
+	closed = true
+	require.Equal(t, captureCounts{25, 2, 0}, c.totals())
+
+	unregister()
+	require.Equal(t, captureCounts{25, 2, 0}, c.totals())
+}
+
+func TestReceivedStats(t *testing.T) {
+	s := &sendStats{}
+	require.Equal(t, "-", s.received())
+
+	s.incReceived("tls", "tcp_rst")
+	s.incReceived("tls", "tcp_data")
+	s.incReceived("dns", "udp")
+	s.incRetry()
+	require.Equal(t, "dns:1,tls:2", s.received())
+	require.Equal(t, int64(1), s.rt)
+}
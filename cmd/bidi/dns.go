@@ -8,6 +8,8 @@ import (
 	"math/rand"
 	"net"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/google/gopacket"
@@ -21,31 +23,176 @@ type dnsProber struct {
 	sender *udpSender
 	qType  uint
 
+	// qTypeList is the comma separated -qtypes flag, parsed into qTypes by
+	// parseOptions.
+	qTypeList string
+	qTypes    []uint16
+
+	edns       bool
+	ednsSize   uint
+	ednsDO     bool
+	ednsCookie bool
+	ednsPad    int
+	ecsString  string
+	ecs        *dns.EDNS0_SUBNET
+
+	qname qnameOptions
+
 	outDir      string
 	CaptureICMP bool
 }
 
 func (p *dnsProber) registerFlags() {
-	flag.UintVar(&p.qType, "qtype", 1, "[DNS] Type of Query to send (1 = A / 28 = AAAA)")
+	flag.UintVar(&p.qType, "qtype", 1, "[DNS/DNS-TCP] Type of Query to send (1 = A / 28 = AAAA)")
+	flag.StringVar(&p.qTypeList, "qtypes", "", "[DNS/DNS-TCP] Comma separated query types to send for each probe by name or number (e.g. A,AAAA,HTTPS,SVCB,TXT,MX,NS). Overrides -qtype")
+	flag.BoolVar(&p.edns, "edns", false, "[DNS/DNS-TCP] Add an EDNS0 OPT record. Implied by the other -edns options")
+	flag.UintVar(&p.ednsSize, "edns-size", 1232, "[DNS/DNS-TCP] EDNS0 UDP payload size")
+	flag.BoolVar(&p.ednsDO, "edns-do", false, "[DNS/DNS-TCP] Set the EDNS0 DNSSEC OK (DO) bit")
+	flag.StringVar(&p.ecsString, "edns-ecs", "", "[DNS/DNS-TCP] EDNS0 Client Subnet to send (e.g. 192.0.2.0/24)")
+	flag.BoolVar(&p.ednsCookie, "edns-cookie", false, "[DNS/DNS-TCP] Send a random EDNS0 client cookie")
+	flag.IntVar(&p.ednsPad, "edns-padding", 0, "[DNS/DNS-TCP] Pad queries to a multiple of this block size with the EDNS0 padding option (e.g. 128). 0 disables padding")
+	flag.BoolVar(&p.qname.randomCase, "qname-0x20", false, "[DNS/DNS-TCP] Randomize the capitalization of the query name (0x20 encoding)")
+	flag.BoolVar(&p.qname.trailingDot, "qname-trailing-dot", false, "[DNS/DNS-TCP] Append a literal (escaped) dot to the last label of the query name")
+	flag.IntVar(&p.qname.prefixLen, "qname-prefix", 0, "[DNS/DNS-TCP] Prepend a random label of this length to the query name (<rand>.domain). 0 disables the prefix")
+	flag.BoolVar(&p.qname.pad, "qname-pad", false, "[DNS/DNS-TCP] Prepend random max length labels until the query name is the maximum length")
 }
 
-func (p *dnsProber) sendProbe(ip net.IP, name string, verbose bool) error {
+// parseOptions parses the query type list and EDNS options. It must be called
+// after flags are parsed and before probes are built.
+func (p *dnsProber) parseOptions() error {
+	p.qTypes = []uint16{uint16(p.qType)}
+	if p.qTypeList != "" {
+		qTypes, err := parseQTypes(p.qTypeList)
+		if err != nil {
+			return err
+		}
+		p.qTypes = qTypes
+	}
+
+	if p.ecsString != "" {
+		ecs, err := parseECS(p.ecsString)
+		if err != nil {
+			return err
+		}
+		p.ecs = ecs
+	}
+
+	if p.qname.prefixLen < 0 || p.qname.prefixLen > maxLabelLen {
+		return fmt.Errorf("bad qname prefix length %d", p.qname.prefixLen)
+	} else if p.ednsPad < 0 || p.ednsPad > 0xffff {
+		return fmt.Errorf("bad edns padding block size %d", p.ednsPad)
+	} else if p.ednsSize > 0xffff {
+		return fmt.Errorf("bad edns udp size %d", p.ednsSize)
+	}
 
-	out, err := p.buildPayload(name)
+	p.edns = p.edns || p.ednsDO || p.ednsCookie || p.ednsPad > 0 || p.ecs != nil
+	return nil
+}
+
+// parseQTypes parses a comma separated list of query types given by name
+// (e.g. HTTPS) or number (e.g. 65).
+func parseQTypes(list string) ([]uint16, error) {
+	var qTypes []uint16
+	for _, s := range strings.Split(list, ",") {
+		s = strings.ToUpper(strings.TrimSpace(s))
+		if t, ok := dns.StringToType[s]; ok {
+			qTypes = append(qTypes, t)
+			continue
+		}
+		t, err := strconv.ParseUint(strings.TrimPrefix(s, "TYPE"), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("unknown query type \"%s\"", s)
+		}
+		qTypes = append(qTypes, uint16(t))
+	}
+	return qTypes, nil
+}
+
+// parseECS parses a client subnet in CIDR notation into an EDNS0 option.
+func parseECS(s string) (*dns.EDNS0_SUBNET, error) {
+	_, subnet, err := net.ParseCIDR(s)
 	if err != nil {
-		return fmt.Errorf("failed to build udp payload: %s", err)
+		return nil, fmt.Errorf("bad edns client subnet \"%s\": %s", s, err)
 	}
 
+	ones, _ := subnet.Mask.Size()
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(ones),
+		Address:       subnet.IP,
+	}
+	if subnet.IP.To4() != nil {
+		ecs.Family = 1
+	} else {
+		ecs.Family = 2
+	}
+	return ecs, nil
+}
+
+func (p *dnsProber) sendProbe(ip net.IP, name string, verbose bool) error {
+
 	addr := net.JoinHostPort(ip.String(), "53")
-	sport, err := p.sender.sendUDP(addr, 0, out, verbose)
-	if err == nil && verbose {
-		log.Printf("Sent :%s -> %s %s %s\n", sport, addr, name, hex.EncodeToString(out))
+	for _, qType := range p.queryTypes() {
+		qname := p.qname.qname(name)
+		out, err := p.buildQuery(qname, qType)
+		if err != nil {
+			return fmt.Errorf("failed to build udp payload: %s", err)
+		}
+
+		laddr, err := p.sender.sendUDP(addr, 0, out, verbose)
+		if err != nil {
+			return err
+		} else if verbose {
+			log.Printf("Sent %s -> %s %s %s %s %s\n", laddr, addr, name, qname, p.variant(qType), hex.EncodeToString(out))
+		}
+	}
+
+	return nil
+}
+
+// queryTypes returns the query types sent for each probe.
+func (p *dnsProber) queryTypes() []uint16 {
+	if len(p.qTypes) == 0 {
+		return []uint16{uint16(p.qType)}
+	}
+	return p.qTypes
+}
+
+// variant describes the query type and EDNS options of a query for the send
+// log, e.g. "HTTPS edns:1232,do,ecs:192.0.2.0/24,cookie,pad:128".
+func (p *dnsProber) variant(qTypes ...uint16) string {
+	var names []string
+	for _, t := range qTypes {
+		names = append(names, dns.Type(t).String())
+	}
+	v := strings.Join(names, "+")
+	if !p.edns {
+		return v
 	}
 
-	return err
+	opts := []string{fmt.Sprintf("edns:%d", p.ednsSize)}
+	if p.ednsDO {
+		opts = append(opts, "do")
+	}
+	if p.ecs != nil {
+		opts = append(opts, fmt.Sprintf("ecs:%s/%d", p.ecs.Address, p.ecs.SourceNetmask))
+	}
+	if p.ednsCookie {
+		opts = append(opts, "cookie")
+	}
+	if p.ednsPad > 0 {
+		opts = append(opts, fmt.Sprintf("pad:%d", p.ednsPad))
+	}
+	return v + " " + strings.Join(opts, ",")
 }
 
+// buildPayload builds a query for name with the first configured query type.
 func (p *dnsProber) buildPayload(name string) ([]byte, error) {
+	return p.buildQuery(p.qname.qname(name), p.queryTypes()[0])
+}
+
+// buildQuery builds a query for the exact query name qname.
+func (p *dnsProber) buildQuery(qname string, qType uint16) ([]byte, error) {
 	m := &dns.Msg{
 		MsgHdr: dns.MsgHdr{
 			Authoritative:     false,
@@ -57,8 +204,8 @@ func (p *dnsProber) buildPayload(name string) ([]byte, error) {
 		Question: make([]dns.Question, 1),
 	}
 	m.Question[0] = dns.Question{
-		Name:   dns.Fqdn(name),
-		Qtype:  uint16(p.qType),
+		Name:   dns.Fqdn(qname),
+		Qtype:  qType,
 		Qclass: uint16(0x0001), // IN
 	}
 
@@ -66,13 +213,54 @@ func (p *dnsProber) buildPayload(name string) ([]byte, error) {
 	dns.Id = func() uint16 { return uint16(rand.Uint32()) }
 	m.Id = dns.Id()
 
+	if p.edns {
+		p.addOPT(m)
+	}
+
 	out, err := m.Pack()
 	if err != nil {
 		return nil, err
 	}
+
+	if p.ednsPad > 0 {
+		// the padding option itself adds a 4 byte option header
+		opt := m.IsEdns0()
+		n := p.ednsPad - (len(out)+4)%p.ednsPad
+		if n == p.ednsPad {
+			n = 0
+		}
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, n)})
+		return m.Pack()
+	}
 	return out, nil
 }
 
+// addOPT adds the EDNS0 OPT record (without padding) to m.
+func (p *dnsProber) addOPT(m *dns.Msg) {
+	opt := &dns.OPT{
+		Hdr: dns.RR_Header{
+			Name:   ".",
+			Rrtype: dns.TypeOPT,
+		},
+	}
+	opt.SetUDPSize(uint16(p.ednsSize))
+	opt.SetDo(p.ednsDO)
+
+	if p.ecs != nil {
+		ecs := *p.ecs
+		opt.Option = append(opt.Option, &ecs)
+	}
+	if p.ednsCookie {
+		cookie := make([]byte, 8)
+		rand.Read(cookie)
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+			Code:   dns.EDNS0COOKIE,
+			Cookie: hex.EncodeToString(cookie),
+		})
+	}
+	m.Extra = append(m.Extra, opt)
+}
+
 func (p *dnsProber) handlePcap(iface string, exit chan struct{}, wg *sync.WaitGroup) {
 	pcapName := dnsProbeTypeName + ".pcap"
 	bpfFilter := "udp src port 53"
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQTypes(t *testing.T) {
+	qTypes, err := parseQTypes("A,aaaa, HTTPS,SVCB,TXT,MX,NS,65,TYPE99")
+	require.Nil(t, err)
+	require.Equal(t, []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeHTTPS, dns.TypeSVCB, dns.TypeTXT, dns.TypeMX, dns.TypeNS, dns.TypeHTTPS, 99}, qTypes)
+
+	_, err = parseQTypes("A,BOGUS")
+	require.NotNil(t, err)
+}
+
+func TestDNSQueryOptions(t *testing.T) {
+	p := &dnsProber{qType: 1, qTypeList: "HTTPS,A"}
+	require.Nil(t, p.parseOptions())
+	require.False(t, p.edns)
+	require.Equal(t, "HTTPS", p.variant(dns.TypeHTTPS))
+
+	out, err := p.buildPayload("example.com")
+	require.Nil(t, err)
+	m := new(dns.Msg)
+	require.Nil(t, m.Unpack(out))
+	require.Equal(t, dns.TypeHTTPS, m.Question[0].Qtype)
+	require.Nil(t, m.IsEdns0())
+
+	p = &dnsProber{qType: 1, ednsSize: 1400, ednsDO: true, ednsCookie: true, ednsPad: 128, ecsString: "192.0.2.0/24"}
+	require.Nil(t, p.parseOptions())
+	require.True(t, p.edns)
+	require.Equal(t, "A+AAAA edns:1400,do,ecs:192.0.2.0/24,cookie,pad:128", p.variant(dns.TypeA, dns.TypeAAAA))
+
+	out, err = p.buildQuery("example.com", dns.TypeSVCB)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(out)%128)
+
+	m = new(dns.Msg)
+	require.Nil(t, m.Unpack(out))
+	require.Equal(t, dns.TypeSVCB, m.Question[0].Qtype)
+	opt := m.IsEdns0()
+	require.NotNil(t, opt)
+	require.Equal(t, uint16(1400), opt.UDPSize())
+	require.True(t, opt.Do())
+
+	var codes []uint16
+	for _, o := range opt.Option {
+		codes = append(codes, o.Option())
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			require.Equal(t, uint16(1), ecs.Family)
+			require.Equal(t, uint8(24), ecs.SourceNetmask)
+			require.Equal(t, "192.0.2.0", ecs.Address.String())
+		}
+	}
+	require.Equal(t, []uint16{dns.EDNS0SUBNET, dns.EDNS0COOKIE, dns.EDNS0PADDING}, codes)
+
+	p = &dnsProber{ecsString: "bogus"}
+	require.NotNil(t, p.parseOptions())
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const dnsTCPProbeTypeName = "dns-tcp"
+
+// dnsTCPProber sends the same DNS queries as dnsProber over TCP port 53 so
+// that injection on DNS over TCP can be compared directly with DNS over UDP.
+// Query options (e.g. -qtype) are shared with the dns prober.
+type dnsTCPProber struct {
+	sender *tcpSender
+
+	// query builds the DNS query payloads
+	query *dnsProber
+
+	dkt *KeyTable
+
+	outDir      string
+	CaptureICMP bool
+}
+
+func (p *dnsTCPProber) registerFlags() {
+}
+
+func (p *dnsTCPProber) sendProbe(ip net.IP, name string, verbose bool) error {
+	laddr, addr, err := p.sendTrigger(ip, name, verbose)
+	if err != nil {
+		return err
+	}
+	return p.sender.sendResidual(laddr, addr, name, p.buildPayload, verbose)
+}
+
+// sendTrigger sends the probe without scheduling residual control probes.
+func (p *dnsTCPProber) sendTrigger(ip net.IP, name string, verbose bool) (string, string, error) {
+
+	qname := p.query.qname.qname(name)
+	out, err := p.buildQueries(qname)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to build dns-tcp payload: %s", err)
+	}
+
+	sport, _ := p.dkt.get(name)
+
+	// The name appears in wire format (length prefixed labels) in the query,
+	// which is what segmenting inside the domain has to look for.
+	addr := net.JoinHostPort(ip.String(), "53")
+	seqAck, laddr, err := p.sender.sendTCP(addr, sport.(int), dnsWireName(qname), out, verbose)
+	if err != nil {
+		return "", "", err
+	} else if verbose {
+		log.Printf("Sent %s -> %s %s %s %s %s %s %s\n", laddr, addr, name, qname, seqAck, p.query.variant(p.query.queryTypes()...), p.sender.timing(), hex.EncodeToString(out))
+	}
+
+	return laddr, addr, nil
+}
+
+// buildPayload builds the DNS queries for each configured query type, each
+// framed with the 2 byte length prefix used for DNS over TCP (RFC 1035 section
+// 4.2.2). Multiple queries are pipelined in the same payload (RFC 7766).
+func (p *dnsTCPProber) buildPayload(name string) ([]byte, error) {
+	return p.buildQueries(p.query.qname.qname(name))
+}
+
+// buildQueries builds the framed queries for the exact query name qname.
+func (p *dnsTCPProber) buildQueries(qname string) ([]byte, error) {
+	var out []byte
+	for _, qType := range p.query.queryTypes() {
+		query, err := p.query.buildQuery(qname, qType)
+		if err != nil {
+			return nil, err
+		}
+
+		out = binary.BigEndian.AppendUint16(out, uint16(len(query)))
+		out = append(out, query...)
+	}
+	return out, nil
+}
+
+func (p *dnsTCPProber) handlePcap(iface string, exit chan struct{}, wg *sync.WaitGroup) {
+	pcapName := dnsTCPProbeTypeName + ".pcap"
+	bpfFilter := "tcp src port 53"
+
+	pcapPath := filepath.Join(p.outDir, pcapName)
+
+	if p.CaptureICMP {
+		bpfFilter = "icmp or icmp6 or " + bpfFilter
+	}
+	capturePcap(iface, pcapPath, bpfFilter, exit, wg)
+}
+
+// dnsWireName returns name in DNS wire format without the terminating root
+// label, e.g. "\x07example\x03com". Escapes in name (e.g. "\.") are decoded.
+func dnsWireName(name string) string {
+	buf := make([]byte, maxNameLen)
+	n, err := dns.PackDomainName(dns.Fqdn(name), buf, 0, nil, false)
+	if err != nil || n < 1 {
+		return ""
+	}
+	return string(buf[:n-1])
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSTCPPayload(t *testing.T) {
+	p := &dnsTCPProber{query: &dnsProber{qType: uint(dns.TypeAAAA)}}
+
+	out, err := p.buildPayload("example.com")
+	require.Nil(t, err)
+	require.Equal(t, len(out)-2, int(binary.BigEndian.Uint16(out)))
+
+	m := new(dns.Msg)
+	require.Nil(t, m.Unpack(out[2:]))
+	require.Equal(t, 1, len(m.Question))
+	require.Equal(t, "example.com.", m.Question[0].Name)
+	require.Equal(t, dns.TypeAAAA, m.Question[0].Qtype)
+
+	// the wire format name can be found in the query for segmentation
+	require.Equal(t, "\x07example\x03com", dnsWireName("example.com."))
+	s, err := parseSegmenter("domain", "", 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(s.split(out, dnsWireName("example.com"))))
+
+	// multiple query types are pipelined in one payload
+	p = &dnsTCPProber{query: &dnsProber{qTypes: []uint16{dns.TypeA, dns.TypeHTTPS}}}
+	out, err = p.buildPayload("example.com")
+	require.Nil(t, err)
+
+	var qTypes []uint16
+	for len(out) > 0 {
+		n := int(binary.BigEndian.Uint16(out))
+		require.Nil(t, m.Unpack(out[2:2+n]))
+		qTypes = append(qTypes, m.Question[0].Qtype)
+		out = out[2+n:]
+	}
+	require.Equal(t, []uint16{dns.TypeA, dns.TypeHTTPS}, qTypes)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const dotProbeTypeName = "dot"
+
+// dotProber sends the TLS ClientHello used by the tls prober to the DNS over
+// TLS port (853) with the "dot" ALPN so that censorship of encrypted DNS
+// endpoints can be compared with HTTPS on 443.
+type dotProber struct {
+	sender *tcpSender
+
+	dkt *KeyTable
+
+	send1_3 bool
+	alpn    string
+
+	// fingerprint, if set, is the client profile ClientHello sent (with its
+	// ALPN extension replaced).
+	fingerprint *helloTemplate
+
+	outDir      string
+	CaptureICMP bool
+}
+
+func (p *dotProber) registerFlags() {
+	flag.BoolVar(&p.send1_3, "dot-tls13", false, "[DOT] Send a TLS 1.3 ClientHello instead of TLS 1.2")
+	flag.StringVar(&p.alpn, "dot-alpn", "dot", "[DOT] Comma separated ALPN protocols to offer. Empty string omits the ALPN extension")
+}
+
+func (p *dotProber) sendProbe(ip net.IP, name string, verbose bool) error {
+	laddr, addr, err := p.sendTrigger(ip, name, verbose)
+	if err != nil {
+		return err
+	}
+	return p.sender.sendResidual(laddr, addr, name, p.buildPayload, verbose)
+}
+
+// sendTrigger sends the probe without scheduling residual control probes.
+func (p *dotProber) sendTrigger(ip net.IP, name string, verbose bool) (string, string, error) {
+
+	out, err := p.buildPayload(name)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to build dot payload: %s", err)
+	}
+
+	sport, _ := p.dkt.get(name)
+
+	addr := net.JoinHostPort(ip.String(), "853")
+	seqAck, laddr, err := p.sender.sendTCP(addr, sport.(int), name, out, verbose)
+	if err != nil {
+		return "", "", err
+	} else if verbose {
+		log.Printf("Sent %s -> %s %s %s %s\n", laddr, addr, name, seqAck, p.sender.timing())
+	}
+
+	return laddr, addr, nil
+}
+
+// buildPayload builds a tls ClientHello with the tested domain as the SNI and
+// the configured ALPN protocols.
+func (p *dotProber) buildPayload(name string) ([]byte, error) {
+	if p.fingerprint != nil {
+		hello, err := p.fingerprint.build(name)
+		if err != nil || p.alpn == "" {
+			return hello, err
+		}
+		return withALPN(hello, strings.Split(p.alpn, ","), p.fingerprint.padded())
+	}
+
+	var h *clientHello
+	var err error
+	if p.send1_3 {
+		h, err = newTLS1_3Hello(name)
+	} else {
+		h, err = newTLS1_2Hello(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.alpn != "" {
+		if err := h.setALPN(strings.Split(p.alpn, ",")); err != nil {
+			return nil, err
+		}
+	}
+	return h.marshal()
+}
+
+func (p *dotProber) handlePcap(iface string, exit chan struct{}, wg *sync.WaitGroup) {
+	pcapName := dotProbeTypeName + ".pcap"
+	bpfFilter := "tcp src port 853"
+
+	pcapPath := filepath.Join(p.outDir, pcapName)
+
+	if p.CaptureICMP {
+		bpfFilter = "icmp or icmp6 or " + bpfFilter
+	}
+	capturePcap(iface, pcapPath, bpfFilter, exit, wg)
+}
@@ -59,9 +59,9 @@ func (p *dtlsProber) sendProbe(ip net.IP, name string, verbose bool) error {
 	} else {
 		addr = net.JoinHostPort(ip.String(), "443")
 	}
-	sport, err = p.sender.sendUDP(addr, sport.(int), out, verbose)
+	laddr, err := p.sender.sendUDP(addr, sport.(int), out, verbose)
 	if err == nil && verbose {
-		log.Printf("Sent :%s -> %s %s %s\n", sport, addr, name, hex.EncodeToString(out))
+		log.Printf("Sent %s -> %s %s %s\n", laddr, addr, name, hex.EncodeToString(out))
 	}
 
 	return err
@@ -117,137 +117,68 @@ func (p *dtlsProber) handlePacket(packet gopacket.Packet) {
 
 func buildDTLS1_3(name string, sendSNI bool) ([]byte, error) {
 	// dynamic(random) - Client KeyShare extension public key
-	buf := make([]byte, 32)
-	n, err := rand.Read(buf)
-	if err != nil || n != 32 {
-		return nil, fmt.Errorf("failed rand read: %s", err)
+	pub, err := randomBytes(32)
+	if err != nil {
+		return nil, err
 	}
-	var extKeySharePubkey = hex.EncodeToString(buf)
-	var extKeyShare = "003300260024001d0020" + extKeySharePubkey
-
-	var otherExtensions = extKeyShare + "002b000302fefc000d0020001e06030503040302030806080b0805080a080408090601050104010301020100160000000a00040002001d"
-
-	// dynamic - Extensions lenggth
-	var extensionsLen = "0061"
-	var extLen = 0x61
-	// var extensionsLen = fmt.Sprintf("%04x", len(name)+0x5f)
-
-	var extSNI = ""
-	if sendSNI {
-		// len name + len SNI extension header + len other extensions.
-		extensionsLen = fmt.Sprintf("%04x", len(name)+9+0x61)
-		extLen += len(name) + 9
-		var extSNIID = "0000"
-		// dynamic - Extension lenggth (0018)
-		var extSNIDataLen = fmt.Sprintf("%04x", len(name)+5)
-		// dynamic - Extension lenggth (0016)
-		var extSNIEntryLen = fmt.Sprintf("%04x", len(name)+3)
-		var extSNIEntryType = "00"
-		// dynamic - Extension lenggth (0013)
-		var hostnameLen = fmt.Sprintf("%04x", len(name))
-		var hostname = hex.EncodeToString([]byte(name))
-		extSNI = extSNIID + extSNIDataLen + extSNIEntryLen + extSNIEntryType + hostnameLen + hostname
+	random, err := randomBytes(32)
+	if err != nil {
+		return nil, err
 	}
 
-	// Ciphersuites & Compression methods
-	var csAndCM = "00061301130213030100"
-
-	// cookie - legacy, not used in DTLS
-	var cookie = "00"
-
-	// session ID - legacy, not used in DTLS
-	var sessionID = "00"
-
-	// dynamic(random) - client Rand (32 generated bytes)
-	buf = make([]byte, 32)
-	n, err = rand.Read(buf)
-	if err != nil || n != 32 {
-		return nil, fmt.Errorf("failed rand read: %s", err)
+	h := &clientHello{
+		recordVersion: dtlsVersion12,
+		// legacy, supported versions extension used now
+		version:            dtlsVersion12,
+		dtls:               true,
+		random:             random,
+		cipherSuites:       []uint16{0x1301, 0x1302, 0x1303},
+		compressionMethods: []uint8{0},
+		extensions: []tlsExtension{
+			keyShareExtension(keyShare{groupX25519, pub}),
+			supportedVersionsExtension(dtlsVersion13),
+			signatureAlgorithmsExtension(
+				0x0603, 0x0503, 0x0403, 0x0203, 0x0806, 0x080b, 0x0805, 0x080a,
+				0x0804, 0x0809, 0x0601, 0x0501, 0x0401, 0x0301, 0x0201),
+			emptyExtension(extEncryptThenMAC),
+			supportedGroupsExtension(groupX25519),
+		},
 	}
-	var clientRandom = hex.EncodeToString(buf)
-
-	// client version - legacy, supported versions extension used now
-	var cv = "fefd"
-
-	// dynamic - handshake reconstruction data sequence #, offset, and fragment len
-	var rd = "0000" + "000000" + fmt.Sprintf("%06x", extLen+0x30)
-
-	// dynamic - Handshake record type and len ClientHello data in this record
-	var hh = "01" + fmt.Sprintf("%06x", extLen+0x30)
-	// var hh = "01" + fmt.Sprintf("%06x", len(name)+0xc4) + "0303"
-
-	// dynamic - bytes of handshake to follow
-	var packetLen = fmt.Sprintf("%04x", extLen+0x3c)
-	// var packetLen = fmt.Sprintf("%04x", len(name)+0xc8)
-
-	// Record headder
-	var rh = "16fefd0000000000000000"
-
-	fulldata := rh + packetLen + hh + rd + cv + clientRandom + sessionID + cookie + csAndCM + extensionsLen + extSNI + otherExtensions
-	return hex.DecodeString(fulldata)
-}
-
-func buildDTLS1_2(name string, sendSNI bool) ([]byte, error) {
-	var otherExtensions = "00170000ff01000100000a00080006001d00170018000b0002010000230000000d00140012040308040401050308050501080606010201000e0009000600010008000700"
-
-	// dynamic - Extensions lenggth
-	var extensionsLen = "0044"
-	var extLen = 0x44
-	// var extensionsLen = fmt.Sprintf("%04x", len(name)+0x5f)
-
-	var extSNI = ""
 	if sendSNI {
-		// len name + len SNI extension header + len other extensions.
-		extLen += len(name) + 9
-		extensionsLen = fmt.Sprintf("%04x", extLen)
-		var extSNIID = "0000"
-		// dynamic - Extension lenggth (0018)
-		var extSNIDataLen = fmt.Sprintf("%04x", len(name)+5)
-		// dynamic - Extension lenggth (0016)
-		var extSNIEntryLen = fmt.Sprintf("%04x", len(name)+3)
-		var extSNIEntryType = "00"
-		// dynamic - Extension lenggth (0013)
-		var hostnameLen = fmt.Sprintf("%04x", len(name))
-		var hostname = hex.EncodeToString([]byte(name))
-		extSNI = extSNIID + extSNIDataLen + extSNIEntryLen + extSNIEntryType + hostnameLen + hostname
+		h.setServerName(name)
 	}
+	return h.marshal()
+}
 
-	// Ciphersuites & Compression methods
-	var csAndCM = "0016c02bc02fcca9cca8c009c013c00ac014009c002f0035" + "0100"
-
-	// cookie - legacy, not used in DTLS
-	var cookie = "00"
-
-	// session ID - legacy, not used in DTLS
-	var sessionID = "00"
-
+func buildDTLS1_2(name string, sendSNI bool) ([]byte, error) {
 	// dynamic(random) - client Rand (32 generated bytes)
-	buf := make([]byte, 32)
-	n, err := rand.Read(buf)
-	if err != nil || n != 32 {
-		return nil, fmt.Errorf("failed rand read: %s", err)
+	random, err := randomBytes(32)
+	if err != nil {
+		return nil, err
 	}
-	var clientRandom = hex.EncodeToString(buf)
 
-	// client version - legacy, supported versions extension used now
-	var cv = "fefd"
-
-	// dynamic - handshake reconstruction data sequence #, offset, and fragment len
-	var rd = "0000" + "000000" + fmt.Sprintf("%06x", extLen+0x40)
-
-	// dynamic - Handshake record type and len ClientHello data in this record
-	var hh = "01" + fmt.Sprintf("%06x", extLen+0x40)
-	// var hh = "01" + fmt.Sprintf("%06x", len(name)+0xc4) + "0303"
-
-	// dynamic - bytes of handshake to follow
-	var packetLen = fmt.Sprintf("%04x", extLen+0x4c)
-	// var packetLen = fmt.Sprintf("%04x", len(name)+0xc8)
-
-	// Record headder
-	var rh = "16feff0000000000000000"
-
-	fulldata := rh + packetLen + hh + rd + cv + clientRandom + sessionID + cookie + csAndCM + extensionsLen + extSNI + otherExtensions
-	return hex.DecodeString(fulldata)
+	h := &clientHello{
+		recordVersion:      dtlsVersion10,
+		version:            dtlsVersion12,
+		dtls:               true,
+		random:             random,
+		cipherSuites:       []uint16{0xc02b, 0xc02f, 0xcca9, 0xcca8, 0xc009, 0xc013, 0xc00a, 0xc014, 0x009c, 0x002f, 0x0035},
+		compressionMethods: []uint8{0},
+		extensions: []tlsExtension{
+			emptyExtension(extExtendedMasterSecret),
+			renegotiationInfoExtension(),
+			supportedGroupsExtension(groupX25519, 0x0017, 0x0018),
+			pointFormatsExtension(0),
+			emptyExtension(extSessionTicket),
+			signatureAlgorithmsExtension(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601, 0x0201),
+			// SRTP_AES128_CM_HMAC_SHA1_80, SRTP_AEAD_AES_256_GCM, SRTP_AEAD_AES_128_GCM
+			useSRTPExtension([]uint16{0x0001, 0x0008, 0x0007}, nil),
+		},
+	}
+	if sendSNI {
+		h.setServerName(name)
+	}
+	return h.marshal()
 }
 
 func parseRandRange(r string) (int, int, error) {
@@ -8,7 +8,6 @@ package main
 // materially change between the proposals.
 
 import (
-	"encoding/hex"
 	"fmt"
 	"log"
 	"math/rand"
@@ -18,6 +17,7 @@ import (
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"golang.org/x/crypto/cryptobyte"
 )
 
 const echProbeTypeName = "ech"
@@ -33,6 +33,16 @@ type echProber struct {
 
 	send1_3 bool
 
+	// fingerprint, if set, is the client profile ClientHello the ESNI / ECH
+	// extension is added to.
+	fingerprint *helloTemplate
+
+	// sni selects how the tested domain appears in the outer ClientHello
+	sni sniVariant
+
+	// records, if set, splits the ClientHello across multiple TLS records
+	records *tlsRecordSplitter
+
 	outDir      string
 	CaptureICMP bool
 }
@@ -41,32 +51,53 @@ func (p *echProber) registerFlags() {
 }
 
 func (p *echProber) sendProbe(ip net.IP, name string, verbose bool) error {
+	laddr, addr, err := p.sendTrigger(ip, name, verbose)
+	if err != nil {
+		return err
+	}
+	return p.sender.sendResidual(laddr, addr, name, p.buildPayload, verbose)
+}
+
+// sendTrigger sends the probe without scheduling residual control probes.
+func (p *echProber) sendTrigger(ip net.IP, name string, verbose bool) (string, string, error) {
 
 	out, err := p.buildPayload(name)
 	if err != nil {
-		return fmt.Errorf("failed to build tls payload: %s", err)
+		return "", "", fmt.Errorf("failed to build tls payload: %s", err)
 	}
 
 	sport, _ := p.dkt.get(name)
 
 	addr := net.JoinHostPort(ip.String(), "443")
-	seqAck, sport, err := p.sender.sendTCP(addr, sport.(int), name, out, verbose)
-	if err == nil && verbose {
-		log.Printf("Sent :%d -> %s %s %s\n", sport, addr, name, seqAck)
+	seqAck, laddr, err := p.sender.sendTCP(addr, sport.(int), p.sni.hostName(name), out, verbose)
+	if err != nil {
+		return "", "", err
+	} else if verbose {
+		log.Printf("Sent %s -> %s %s sni:%s %s %s\n", laddr, addr, name, p.sni, seqAck, p.sender.timing())
 	}
 
-	return err
+	return laddr, addr, nil
 }
 
 // buildPayload builds a tls payload
-//
-// As demonstrated by the GeneratePayloads perf benchmark lots (~30%) of tls
-// payload build time is spent on hex.Decode which is avoidable. However, for
-// now generating payload is really fast anyways and hex is a convenient format
-// in which to interact with the payload. It might make sense to do hex.Decode
-// calls as some sort of init if speed matters in the future. Or move to using
-// slice init with bytes. But for now it doesn't matter.
 func (p *echProber) buildPayload(name string) ([]byte, error) {
+	hello, err := p.buildHello(name)
+	if err != nil {
+		return nil, err
+	}
+	hello, err = p.sni.apply(hello, name, p.fingerprint.padded())
+	if err != nil {
+		return nil, err
+	}
+	return p.records.split(hello, p.sni.hostName(name))
+}
+
+// buildHello builds the ClientHello with the ESNI / ECH extension.
+func (p *echProber) buildHello(name string) ([]byte, error) {
+	if p.fingerprint != nil {
+		return p.buildFingerprint(name)
+	}
+
 	if p.send1_3 {
 		return buildECH1_3(name, p.ech, p.esni)
 	}
@@ -77,6 +108,21 @@ func (p *echProber) buildPayload(name string) ([]byte, error) {
 	return buildECH1_2(name)
 }
 
+// buildFingerprint builds the fingerprint ClientHello with a random ESNI or ECH
+// extension replacing any (GREASE) extension of the same type.
+func (p *echProber) buildFingerprint(name string) ([]byte, error) {
+	hello, err := p.fingerprint.build(name)
+	if err != nil || !(p.ech || p.esni) {
+		return hello, err
+	}
+
+	ext, err := buildECHExtension(p.ech, p.esni)
+	if err != nil {
+		return nil, err
+	}
+	return withExtension(hello, ext, p.fingerprint.padded())
+}
+
 func (p *echProber) handlePcap(iface string, exit chan struct{}, wg *sync.WaitGroup) {
 	bpfFilter := "tcp src port 443"
 	var pcapName string
@@ -148,189 +194,112 @@ func (p *echProber) handlePacket(packet gopacket.Packet) {
 }
 
 func buildECH1_2(name string) ([]byte, error) {
-	// Record headder
-	var rh = "160301"
-
-	// dynamic - bytes of handshake to follow
-	var packetLen = fmt.Sprintf("%04x", len(name)+0xc8)
-
-	// Handshake header and client version
-	var hh = "01" + fmt.Sprintf("%06x", len(name)+0xc4) + "0303"
+	return buildTLS1_2(name)
+}
 
-	// dynamic - client Rand (32 generated bytes)
-	buf := make([]byte, 32)
-	n, err := rand.Read(buf)
-	if err != nil || n != 32 {
-		return nil, fmt.Errorf("failed rand read: %s", err)
+func buildECH1_3(name string, ech, esni bool) ([]byte, error) {
+	var extECH *tlsExtension
+	if ech || esni {
+		ext, err := buildECHExtension(ech, esni)
+		if err != nil {
+			return nil, err
+		}
+		extECH = &ext
 	}
-	// var clientRandom = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
-	var clientRandom = hex.EncodeToString(buf)
 
-	// dynamic - session ID (33 bytes 32 generated)
-	n, err = rand.Read(buf)
-	if err != nil || n != 32 {
-		return nil, fmt.Errorf("failed rand read: %s", err)
+	// dynamic(random) - Client KeyShare extension public key
+	pub, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	sessionID, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	random, err := randomBytes(32)
+	if err != nil {
+		return nil, err
 	}
-	// var sessionID = "20e0e1e2e3e4e5e6e7e8e9eaebecedeeeff0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"
-	var sessionID = "20" + hex.EncodeToString(buf)
-
-	// Ciphersuites & Compression methods
-	var csAndCM = "001cc02bc02fcca9cca8c02cc030c00ac009c013c014009c009d002f00350100"
-
-	// dynamic - Extensions lenggth (00a3)
-	var extensionsLen = fmt.Sprintf("%04x", len(name)+0x5f)
-
-	var extSNIID = "0000"
-	// dynamic - Extension lenggth (0018)
-	var extSNIDataLen = fmt.Sprintf("%04x", len(name)+5)
-	// dynamic - Extension lenggth (0016)
-	var extSNIEntryLen = fmt.Sprintf("%04x", len(name)+3)
-	var extSNIEntryType = "00"
-	// dynamic - Extension lenggth (0013)
-	var hostnameLen = fmt.Sprintf("%04x", len(name))
-	var hostname = hex.EncodeToString([]byte(name))
-
-	var otherExtensions = "000b000403000102000a00160014001d0017001e0019001801000101010201030104002300000016000000170000000d001e001c040305030603080708080809080a080b080408050806040105010601002d00020101"
 
-	fulldata := rh + packetLen + hh + clientRandom + sessionID + csAndCM + extensionsLen + extSNIID + extSNIDataLen + extSNIEntryLen + extSNIEntryType + hostnameLen + hostname + otherExtensions
-	return hex.DecodeString(fulldata)
+	h := tls13Hello(name, random, sessionID, pub)
+	if extECH != nil {
+		// the ESNI / ECH extension directly follows the SNI
+		h.insertExtension(1, *extECH)
+	}
+	return h.marshal()
 }
 
-func buildECH1_3(name string, ech, esni bool) ([]byte, error) {
-	// var fulldata = "16030100f8010000f40303000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20e0e1e2e3e4e5e6e7e8e9eaebecedeeeff0f1f2f3f4f5f6f7f8f9fafbfcfdfeff000813021303130100ff010000a30000001800160000136578616d706c652e756c666865696d2e6e6574000b000403000102000a00160014001d0017001e0019001801000101010201030104002300000016000000170000000d001e001c040305030603080708080809080a080b080408050806040105010601002b0003020304002d00020101003300260024001d0020358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254"
-
-	var extLen = len(name) + 4 + 0x8c
-
-	var extSNIID = "0000"
-	// dynamic - Extension lenggth (0018)
-	var extSNIDataLen = fmt.Sprintf("%04x", len(name)+5)
-	// dynamic - Extension lenggth (0016)
-	var extSNIEntryLen = fmt.Sprintf("%04x", len(name)+3)
-	var extSNIEntryType = "00"
-	// dynamic - Extension lenggth (0013)
-	var hostnameLen = fmt.Sprintf("%04x", len(name))
-	var hostname = hex.EncodeToString([]byte(name))
-	var extSNI = extSNIID + extSNIDataLen + extSNIEntryLen + extSNIEntryType + hostnameLen + hostname
-
-	var extESNI = ""
-	var extECH = ""
+// buildECHExtension builds a (random) ESNI or ECH extension. If both are set
+// ESNI is built.
+func buildECHExtension(ech, esni bool) (tlsExtension, error) {
+	b := cryptobyte.NewBuilder(nil)
 	if esni {
 		recordLen := rand.Intn(320-100+1) + 100
 
-		// dynamic(random) - Encrypted Client Hello extension
-		var extESNIHeader = "ffce" + fmt.Sprintf("%04x", recordLen+0x4a) + "1301001d0020"
-		buf := make([]byte, 32)
-		n, err := rand.Read(buf)
-		if err != nil || n != 32 {
-			return nil, fmt.Errorf("failed rand read: %s", err)
-		}
-		var extESNIKeyExchange = hex.EncodeToString(buf)
-		buf = make([]byte, 32)
-		n, err = rand.Read(buf)
-		if err != nil || n != 32 {
-			return nil, fmt.Errorf("failed rand read: %s", err)
+		keyExchange, err := randomBytes(32)
+		if err != nil {
+			return tlsExtension{}, err
 		}
-		var extESNIDigest = hex.EncodeToString(buf)
-		buf = make([]byte, recordLen)
-		n, err = rand.Read(buf)
-		if err != nil || n != recordLen {
-			return nil, fmt.Errorf("failed rand read: %s", err)
+		digest, err := randomBytes(32)
+		if err != nil {
+			return tlsExtension{}, err
 		}
-		var extESNIRecord = hex.EncodeToString(buf)
-		extESNI = extESNIHeader + extESNIKeyExchange + "0020" + extESNIDigest + fmt.Sprintf("%04x", recordLen) + extESNIRecord
-		extLen += len(extESNI) / 2
-	} else if ech {
-		// extension id fe0d draft 13 and 14 ( fe0c draft 12/ fe0e non-existent draft 15? )
-		// len (2B)
-		// type (1B?)
-		// kdf (2B?)
-		// aead (2B?)
-		// config id (1B)
-		// enc len (2B)
-		// enc (20B)
-		// payload_len (2B)
-		// payload
-		payloadLen := rand.Intn(320-100+1) + 100
-
-		// dynamic(random) - Encrypted Client Hello extension
-		var extECHHeader = "fe0d" + fmt.Sprintf("%04x", payloadLen+42) + "0000010001"
-		buf := make([]byte, 1)
-		n, err := rand.Read(buf)
-		if err != nil || n != 1 {
-			return nil, fmt.Errorf("failed rand read: %s", err)
+		record, err := randomBytes(recordLen)
+		if err != nil {
+			return tlsExtension{}, err
 		}
-		var extECHConfigID = hex.EncodeToString(buf)
-		buf = make([]byte, 32)
-		n, err = rand.Read(buf)
-		if err != nil || n != 32 {
-			return nil, fmt.Errorf("failed rand read: %s", err)
-		}
-		var extECHEnc = hex.EncodeToString(buf)
 
-		buf = make([]byte, payloadLen)
-		n, err = rand.Read(buf)
-		if err != nil || n != payloadLen {
-			return nil, fmt.Errorf("failed rand read: %s", err)
-		}
-		var extECHRecord = hex.EncodeToString(buf)
-		extECH = extECHHeader + extECHConfigID + "0020" + extECHEnc + fmt.Sprintf("%04x", payloadLen) + extECHRecord
-		extLen += len(extECH) / 2
-
-		// 00
-		// 0001
-		// 0001
-		// f5
-		// 0020
-		// aaa4f06190b9037c7b628b0a7b0bc27d69ef50761612db01600c57e7744eed30
-		// 0110
-		// fa14ecc6c65cedf4ecb108ee383be7d7325db934deb7dbf8254179e374a31908a2feceef9a8a458815e612e17e1075c0f6293a35c5f152d8ed0642632ff69c621f43e60d09a7260291537551a079a15e08ad941c75ec143602b18911e2fddb2c0135cdf3e5a91b02ad6e78a5eddc32b13772c10aa6b101a47e353cf4187071ee4a1874d052f6459cc826e1dafb2028fb7ce22746a295d7ecc405ad20cc3c918c5a3a93a4c3c2846d9327e22cbe617c4d7512214c259ab1f5a6af136376cbc577ff991eb12c362a877edcf28673c2480c4db04630baa4ed2ed17c170a3c46714bef8e6bc20dfe593ddf4e7d71bda993f05859fa1bbb91936668d662b89e1627e980bf2b575f37d3f22e06bf7b953c36ea
+		b.AddUint16(0x1301) // TLS_AES_128_GCM_SHA256
+		b.AddUint16(groupX25519)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(keyExchange)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(digest)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(record)
+		})
+		return tlsExtension{extESNI, b.BytesOrPanic()}, nil
+	} else if !ech {
+		return tlsExtension{}, fmt.Errorf("neither ech nor esni set")
 	}
 
-	// dynamic(random) - Client KeyShare extension public key
-	buf := make([]byte, 32)
-	n, err := rand.Read(buf)
-	if err != nil || n != 32 {
-		return nil, fmt.Errorf("failed rand read: %s", err)
+	// extension id fe0d draft 13 and 14 ( fe0c draft 12/ fe0e non-existent draft 15? )
+	// type (1B) outer
+	// kdf (2B) HKDF-SHA256
+	// aead (2B) AES-128-GCM
+	// config id (1B)
+	// enc len (2B)
+	// enc (32B)
+	// payload_len (2B)
+	// payload
+	payloadLen := rand.Intn(320-100+1) + 100
+
+	configID, err := randomBytes(1)
+	if err != nil {
+		return tlsExtension{}, err
 	}
-	var extKeySharePubkey = hex.EncodeToString(buf)
-	var extKeyShare = "003300260024001d0020" + extKeySharePubkey
-
-	var otherExtensions = extKeyShare + "000b000403000102000a00160014001d0017001e0019001801000101010201030104002300000016000000170000000d001e001c040305030603080708080809080a080b080408050806040105010601002b0003020304002d00020101"
-
-	// dynamic - Extensions lenggth
-	var extensionsLen = fmt.Sprintf("%04x", extLen)
-
-	// Ciphersuites & Compression methods
-	var csAndCM = "000813021303130100ff0100"
-
-	// dynamic - session ID (33 bytes 32 generated)
-	n, err = rand.Read(buf)
-	if err != nil || n != 32 {
-		return nil, fmt.Errorf("failed rand read: %s", err)
+	enc, err := randomBytes(32)
+	if err != nil {
+		return tlsExtension{}, err
 	}
-	// var sessionID = "20e0e1e2e3e4e5e6e7e8e9eaebecedeeeff0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"
-	var sessionID = "20" + hex.EncodeToString(buf)
-
-	// dynamic - client Rand (32 generated bytes)
-	buf = make([]byte, 32)
-	n, err = rand.Read(buf)
-	if err != nil || n != 32 {
-		return nil, fmt.Errorf("failed rand read: %s", err)
+	payload, err := randomBytes(payloadLen)
+	if err != nil {
+		return tlsExtension{}, err
 	}
-	// var clientRandom = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
-	var clientRandom = hex.EncodeToString(buf)
-
-	// Handshake header and client version
-	var hh = "01" + fmt.Sprintf("%06x", extLen+0x51) + "0303"
-
-	// dynamic - bytes of handshake to follow
-	var packetLen = fmt.Sprintf("%04x", extLen+0x55)
-
-	// Record headder
-	var rh = "160301"
 
-	fulldata := rh + packetLen + hh + clientRandom + sessionID + csAndCM + extensionsLen + extSNI + extESNI + extECH + otherExtensions
-	return hex.DecodeString(fulldata)
+	b.AddUint8(0)
+	b.AddUint16(0x0001)
+	b.AddUint16(0x0001)
+	b.AddBytes(configID)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(enc)
+	})
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(payload)
+	})
+	return tlsExtension{extECH, b.BytesOrPanic()}, nil
 }
 
 /*
@@ -0,0 +1,105 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+//go:generate sh -c "cd ../client-hello-gen && go run . -templates ../bidi/fingerprints.json"
+
+// fingerprintsJSON holds the ClientHello templates of the browser / client
+// profiles generated by client-hello-gen.
+//
+//go:embed fingerprints.json
+var fingerprintsJSON []byte
+
+// helloTemplate is the ClientHello record of a real client generated by
+// client-hello-gen, so ClientHellos matching the client can be built for each
+// probe without uTLS. See client-hello-gen/hello.Template.
+type helloTemplate struct {
+	Name  string `json:"name"`
+	Hello []byte `json:"hello"`
+
+	// Padding is whether the profile pads BoringSSL style.
+	Padding bool `json:"padding"`
+}
+
+// loadHelloTemplate returns the template of the named profile.
+func loadHelloTemplate(name string) (*helloTemplate, error) {
+	var templates []*helloTemplate
+	if err := json.Unmarshal(fingerprintsJSON, &templates); err != nil {
+		return nil, fmt.Errorf("failed to parse fingerprints: %s", err)
+	}
+
+	var names []string
+	for _, t := range templates {
+		if t.Name == name {
+			return t, t.validate()
+		}
+		names = append(names, t.Name)
+	}
+	return nil, fmt.Errorf("unknown fingerprint \"%s\" - must be one of %s", name, strings.Join(names, ", "))
+}
+
+func (t *helloTemplate) validate() error {
+	if _, err := parseClientHello(t.Hello); err != nil {
+		return fmt.Errorf("fingerprint %s: %s", t.Name, err)
+	}
+	return nil
+}
+
+// padded reports whether the profile pads its ClientHellos BoringSSL style. A
+// nil template (the built in ClientHellos) does not.
+func (t *helloTemplate) padded() bool {
+	return t != nil && t.Padding
+}
+
+// build builds the profile's ClientHello for the server name name with new
+// random, session id, key shares, and GREASE ECH.
+func (t *helloTemplate) build(name string) ([]byte, error) {
+	h, err := parseClientHello(t.Hello)
+	if err != nil {
+		return nil, fmt.Errorf("fingerprint %s: %s", t.Name, err)
+	}
+
+	if h.random, err = randomBytes(len(h.random)); err != nil {
+		return nil, err
+	}
+	if h.sessionID, err = randomBytes(len(h.sessionID)); err != nil {
+		return nil, err
+	}
+	// profiles that send no SNI are left without one
+	if h.extension(extServerName) >= 0 {
+		h.setServerName(name)
+	}
+	if err := h.randomizeKeyShares(); err != nil {
+		return nil, err
+	}
+	if err := h.randomizeECH(); err != nil {
+		return nil, err
+	}
+	if t.padded() {
+		if err := h.padBoring(); err != nil {
+			return nil, err
+		}
+	}
+	return h.marshal()
+}
+
+// boringPaddingLen returns the length of the padding extension data BoringSSL
+// adds to a ClientHello handshake message of unpaddedLen bytes, and whether
+// the padding extension is sent at all.
+func boringPaddingLen(unpaddedLen int) (int, bool) {
+	if unpaddedLen > 0xff && unpaddedLen < 0x200 {
+		n := 0x200 - unpaddedLen
+		if n >= 4+1 {
+			n -= 4
+		} else {
+			n = 1
+		}
+		return n, true
+	}
+	return 0, false
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// helloExtensions walks the extensions of a ClientHello record checking that
+// all of the lengths are consistent.
+func helloExtensions(t *testing.T, hello []byte) [][]byte {
+	require.Equal(t, len(hello)-5, int(binary.BigEndian.Uint16(hello[3:])))
+	require.Equal(t, len(hello)-9, int(hello[6])<<16|int(hello[7])<<8|int(hello[8]))
+
+	pos := 43
+	pos += 1 + int(hello[pos])
+	pos += 2 + int(binary.BigEndian.Uint16(hello[pos:]))
+	pos += 1 + int(hello[pos])
+	require.Equal(t, len(hello)-pos-2, int(binary.BigEndian.Uint16(hello[pos:])))
+
+	var exts [][]byte
+	for pos += 2; pos < len(hello); {
+		n := 4 + int(binary.BigEndian.Uint16(hello[pos+2:]))
+		require.LessOrEqual(t, pos+n, len(hello))
+		exts = append(exts, hello[pos:pos+n])
+		pos += n
+	}
+	return exts
+}
+
+func findExtension(exts [][]byte, typ uint16) [][]byte {
+	var found [][]byte
+	for _, ext := range exts {
+		if binary.BigEndian.Uint16(ext) == typ {
+			found = append(found, ext)
+		}
+	}
+	return found
+}
+
+func TestHelloTemplates(t *testing.T) {
+	for _, name := range []string{"chrome", "chrome-legacy", "firefox", "safari", "go", "curl"} {
+		tmpl, err := loadHelloTemplate(name)
+		require.Nil(t, err, name)
+
+		a, err := tmpl.build("example.com")
+		require.Nil(t, err, name)
+		b, err := tmpl.build("example.com")
+		require.Nil(t, err, name)
+
+		exts := helloExtensions(t, a)
+		sni := findExtension(exts, 0x0000)
+		require.Equal(t, 1, len(sni), name)
+		require.True(t, bytes.HasSuffix(sni[0], []byte("\x00\x0bexample.com")), name)
+		require.False(t, bytes.Contains(a, []byte("client-hello-gen.invalid")), name)
+
+		// the other extensions are sent as generated
+		h, err := parseClientHello(tmpl.Hello)
+		require.Nil(t, err, name)
+		var types []uint16
+		for _, ext := range h.extensions {
+			if ext.typ != extPadding {
+				types = append(types, ext.typ)
+			}
+		}
+		var sent []uint16
+		for _, ext := range exts {
+			if typ := binary.BigEndian.Uint16(ext); typ != extPadding {
+				sent = append(sent, typ)
+			}
+		}
+		require.Equal(t, types, sent, name)
+
+		// the random and key shares change for each ClientHello
+		require.Equal(t, len(a), len(b), name)
+		require.NotEqual(t, a[11:43], b[11:43], name)
+		require.NotEqual(t, findExtension(exts, 0x0033), findExtension(helloExtensions(t, b), 0x0033), name)
+
+		// so does the GREASE ECH extension, keeping its header and lengths
+		if ech := findExtension(exts, extECH); len(ech) > 0 {
+			other := findExtension(helloExtensions(t, b), extECH)
+			require.Equal(t, 1, len(other), name)
+			require.Equal(t, len(ech[0]), len(other[0]), name)
+			require.Equal(t, ech[0][:9], other[0][:9], name)
+			require.NotEqual(t, ech[0], other[0], name)
+		}
+
+		if tmpl.padded() {
+			require.Equal(t, 0x200, len(a)-5, name)
+		}
+	}
+
+	// chrome and firefox send GREASE ECH
+	for _, name := range []string{"chrome", "firefox"} {
+		tmpl, err := loadHelloTemplate(name)
+		require.Nil(t, err, name)
+		require.Equal(t, 1, len(findExtension(helloExtensions(t, tmpl.Hello), extECH)), name)
+	}
+
+	_, err := loadHelloTemplate("netscape")
+	require.NotNil(t, err)
+}
+
+func TestFingerprintProbes(t *testing.T) {
+	tmpl, err := loadHelloTemplate("chrome")
+	require.Nil(t, err)
+
+	p := &tlsProber{fingerprint: tmpl}
+	out, err := p.buildPayload("example.com")
+	require.Nil(t, err)
+	helloExtensions(t, out)
+
+	// the (GREASE) ECH extension is replaced
+	e := &echProber{ech: true, send1_3: true, fingerprint: tmpl}
+	out, err = e.buildPayload("example.com")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(findExtension(helloExtensions(t, out), 0xfe0d)))
+
+	// the ALPN extension is replaced
+	d := &dotProber{alpn: "dot", fingerprint: tmpl}
+	out, err = d.buildPayload("example.com")
+	require.Nil(t, err)
+	alpn := findExtension(helloExtensions(t, out), 0x0010)
+	require.Equal(t, 1, len(alpn))
+	require.Equal(t, "\x00\x10\x00\x06\x00\x04\x03dot", string(alpn[0]))
+
+	// the padding is recomputed after the ALPN and ECH extensions change
+	tmpl, err = loadHelloTemplate("safari")
+	require.Nil(t, err)
+	require.True(t, tmpl.padded())
+
+	d = &dotProber{alpn: "dot,h2,http/1.1", fingerprint: tmpl}
+	out, err = d.buildPayload("example.com")
+	require.Nil(t, err)
+	require.Equal(t, 512, len(out)-5)
+	requireBoringPadding(t, out)
+
+	e = &echProber{ech: true, send1_3: true, fingerprint: tmpl}
+	for i := 0; i < 20; i++ {
+		out, err = e.buildPayload("example.com")
+		require.Nil(t, err)
+		requireBoringPadding(t, out)
+	}
+}
+
+// requireBoringPadding checks that the ClientHello record hello is padded the
+// way BoringSSL pads it for its length without the padding extension.
+func requireBoringPadding(t *testing.T, hello []byte) {
+	h, err := parseClientHello(hello)
+	require.Nil(t, err)
+	h.removeExtension(extPadding)
+	b, err := h.marshalHandshake()
+	require.Nil(t, err)
+
+	padding := findExtension(helloExtensions(t, hello), extPadding)
+	if n, ok := boringPaddingLen(len(b)); ok {
+		require.Equal(t, 1, len(padding))
+		require.Equal(t, len(b)+4+n, len(hello)-5)
+	} else {
+		require.Equal(t, 0, len(padding))
+		require.Equal(t, len(b), len(hello)-5)
+	}
+}
+
+func TestBoringPadding(t *testing.T) {
+	_, ok := boringPaddingLen(0xff)
+	require.False(t, ok)
+	_, ok = boringPaddingLen(0x200)
+	require.False(t, ok)
+
+	n, ok := boringPaddingLen(0x100)
+	require.True(t, ok)
+	require.Equal(t, 0x200-0x100-4, n)
+
+	n, ok = boringPaddingLen(0x1fe)
+	require.True(t, ok)
+	require.Equal(t, 1, n)
+}
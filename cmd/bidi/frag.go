@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"syscall"
+
+	"github.com/google/gopacket/layers"
+)
+
+// ipFragmenter splits serialized IPv4 packets into IP fragments, and IPv6
+// packets into fragments carrying an IPv6 Fragment extension header. This lets
+// us measure whether middle-boxes reassemble IP fragments before matching on
+// the SNI / Host / DNS query in the payload.
+type ipFragmenter struct {
+	// size is the maximum number of bytes of IP payload carried in each
+	// fragment. Must be a multiple of 8.
+	size int
+
+	// reverse sends the fragments last to first.
+	reverse bool
+
+	// tinyFirst makes the first fragment carry only 8 bytes of IP payload so
+	// that the transport header is split across fragments.
+	tinyFirst bool
+}
+
+func newIPFragmenter(size int, order string, tinyFirst bool) (*ipFragmenter, error) {
+	if size <= 0 && !tinyFirst {
+		return nil, nil
+	}
+
+	if size <= 0 {
+		// tiny first fragment followed by the rest of the payload
+		size = 0xfff8
+	} else if size%8 != 0 {
+		return nil, fmt.Errorf("fragment size must be a multiple of 8")
+	}
+
+	f := &ipFragmenter{size: size, tinyFirst: tinyFirst}
+	switch order {
+	case "", "forward":
+	case "reverse":
+		f.reverse = true
+	default:
+		return nil, fmt.Errorf("unknown fragment order \"%s\" - must be forward or reverse", order)
+	}
+
+	return f, nil
+}
+
+// fragment splits the packet into fragments in the order they should be sent.
+// Packets that fit in a single fragment are returned unmodified.
+func (f *ipFragmenter) fragment(pkt []byte) ([][]byte, error) {
+	if len(pkt) < 1 {
+		return nil, fmt.Errorf("empty packet")
+	}
+
+	var frags [][]byte
+	var err error
+	switch pkt[0] >> 4 {
+	case 4:
+		frags, err = f.fragmentIPv4(pkt)
+	case 6:
+		frags, err = f.fragmentIPv6(pkt)
+	default:
+		return nil, fmt.Errorf("unknown ip version %d", pkt[0]>>4)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if f.reverse {
+		for i, j := 0, len(frags)-1; i < j; i, j = i+1, j-1 {
+			frags[i], frags[j] = frags[j], frags[i]
+		}
+	}
+	return frags, nil
+}
+
+// chunks returns the [start, end) offsets of each fragment of a payload of
+// length n.
+func (f *ipFragmenter) chunks(n int) [][2]int {
+	var out [][2]int
+	start := 0
+	for start < n {
+		size := f.size
+		if start == 0 && f.tinyFirst {
+			size = 8
+		}
+		end := start + size
+		if end > n {
+			end = n
+		}
+		out = append(out, [2]int{start, end})
+		start = end
+	}
+	return out
+}
+
+func (f *ipFragmenter) fragmentIPv4(pkt []byte) ([][]byte, error) {
+	ihl := int(pkt[0]&0x0f) * 4
+	if len(pkt) < 20 || ihl < 20 || len(pkt) < ihl {
+		return nil, fmt.Errorf("malformed ipv4 packet")
+	}
+	header, payload := pkt[:ihl], pkt[ihl:]
+
+	chunks := f.chunks(len(payload))
+	if len(chunks) <= 1 {
+		return [][]byte{pkt}, nil
+	}
+
+	var frags [][]byte
+	for i, c := range chunks {
+		frag := make([]byte, ihl+c[1]-c[0])
+		copy(frag, header)
+		copy(frag[ihl:], payload[c[0]:c[1]])
+
+		flagsAndOffset := uint16(c[0] / 8)
+		if i < len(chunks)-1 {
+			flagsAndOffset |= 0x2000 // more fragments
+		}
+		binary.BigEndian.PutUint16(frag[2:], uint16(len(frag)))
+		binary.BigEndian.PutUint16(frag[6:], flagsAndOffset)
+		binary.BigEndian.PutUint16(frag[10:], 0)
+		binary.BigEndian.PutUint16(frag[10:], ipv4HeaderChecksum(frag[:ihl]))
+
+		frags = append(frags, frag)
+	}
+	return frags, nil
+}
+
+func (f *ipFragmenter) fragmentIPv6(pkt []byte) ([][]byte, error) {
+	if len(pkt) < 40 {
+		return nil, fmt.Errorf("malformed ipv6 packet")
+	}
+
+	// Walk the extension header chain to find the end of the unfragmentable
+	// part - the IPv6 header plus any Hop-by-Hop and Routing headers (and
+	// Destination Options headers preceding a Routing header).
+	nextHeaderOffset := 6
+	unfragEnd := 40
+	offset := 40
+	nextHeader := layers.IPProtocol(pkt[6])
+	for {
+		if nextHeader != layers.IPProtocolIPv6HopByHop &&
+			nextHeader != layers.IPProtocolIPv6Routing &&
+			nextHeader != layers.IPProtocolIPv6Destination {
+			break
+		}
+		if len(pkt) < offset+8 {
+			return nil, fmt.Errorf("malformed ipv6 extension header")
+		}
+		extLen := (int(pkt[offset+1]) + 1) * 8
+		if nextHeader != layers.IPProtocolIPv6Destination {
+			nextHeaderOffset = offset
+			unfragEnd = offset + extLen
+		}
+		nextHeader = layers.IPProtocol(pkt[offset])
+		offset += extLen
+	}
+
+	header, payload := pkt[:unfragEnd], pkt[unfragEnd:]
+
+	chunks := f.chunks(len(payload))
+	if len(chunks) <= 1 {
+		return [][]byte{pkt}, nil
+	}
+
+	id := rand.Uint32()
+	fragNextHeader := pkt[nextHeaderOffset]
+
+	var frags [][]byte
+	for i, c := range chunks {
+		frag := make([]byte, unfragEnd+8+c[1]-c[0])
+		copy(frag, header)
+		frag[nextHeaderOffset] = byte(layers.IPProtocolIPv6Fragment)
+
+		fragHeader := frag[unfragEnd : unfragEnd+8]
+		fragHeader[0] = fragNextHeader
+		fragHeader[1] = 0
+		offsetAndFlags := uint16(c[0]/8) << 3
+		if i < len(chunks)-1 {
+			offsetAndFlags |= 0x1 // more fragments
+		}
+		binary.BigEndian.PutUint16(fragHeader[2:], offsetAndFlags)
+		binary.BigEndian.PutUint32(fragHeader[4:], id)
+
+		copy(frag[unfragEnd+8:], payload[c[0]:c[1]])
+		binary.BigEndian.PutUint16(frag[4:], uint16(len(frag)-40))
+
+		frags = append(frags, frag)
+	}
+	return frags, nil
+}
+
+func ipv4HeaderChecksum(header []byte) uint16 {
+	var csum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		csum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for csum > 0xffff {
+		csum = (csum >> 16) + (csum & 0xffff)
+	}
+	return ^uint16(csum)
+}
+
+// sendFragmented sends the packet using sendPkt, first splitting it into IP
+// fragments if a fragmenter is provided.
+func sendFragmented(sockFd int, pkt []byte, addr syscall.Sockaddr, f *ipFragmenter) error {
+	if f == nil {
+		return sendPkt(sockFd, pkt, addr)
+	}
+
+	frags, err := f.fragment(pkt)
+	if err != nil {
+		return err
+	}
+
+	for _, frag := range frags {
+		err = sendPkt(sockFd, frag, addr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+)
+
+func testUDPPacket(t *testing.T, ipLayer netLayer, payload []byte) []byte {
+	return testUDPPacketTo(t, ipLayer, 53, payload)
+}
+
+// testUDPPacketTo is testUDPPacket sent to dport, e.g. for payloads that are
+// not DNS messages, which gopacket would fail to decode on port 53.
+func testUDPPacketTo(t *testing.T, ipLayer netLayer, dport layers.UDPPort, payload []byte) []byte {
+	udpLayer := &layers.UDP{SrcPort: 1234, DstPort: dport}
+	udpLayer.SetNetworkLayerForChecksum(ipLayer)
+
+	buf := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, options, ipLayer, udpLayer, gopacket.Payload(payload))
+	require.Nil(t, err)
+	return buf.Bytes()
+}
+
+func TestFragmentIPv4(t *testing.T) {
+	ipLayer := &layers.IPv4{
+		SrcIP:    net.ParseIP("192.168.0.1"),
+		DstIP:    net.ParseIP("192.168.0.2"),
+		Version:  4,
+		TTL:      64,
+		Id:       1234,
+		Protocol: layers.IPProtocolUDP,
+	}
+	payload := bytes.Repeat([]byte("abcdefgh"), 10)
+	pkt := testUDPPacket(t, ipLayer, payload)
+
+	f, err := newIPFragmenter(32, "forward", true)
+	require.Nil(t, err)
+
+	frags, err := f.fragment(pkt)
+	require.Nil(t, err)
+	// 88 bytes of ip payload -> 8 + 32 + 32 + 16
+	require.Equal(t, 4, len(frags))
+
+	var reassembled []byte
+	for i, frag := range frags {
+		p := gopacket.NewPacket(frag, layers.LayerTypeIPv4, gopacket.Default)
+		ip4 := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		require.Equal(t, uint16(1234), ip4.Id)
+		require.Equal(t, uint16(len(reassembled)/8), ip4.FragOffset)
+		require.Equal(t, i < len(frags)-1, ip4.Flags&layers.IPv4MoreFragments != 0)
+		require.Equal(t, ipv4HeaderChecksum(frag[:20]), uint16(0))
+		reassembled = append(reassembled, ip4.Payload...)
+	}
+	require.Equal(t, 8, len(frags[0])-20)
+	require.Equal(t, pkt[20:], reassembled)
+
+	// reverse order sends the last fragment first
+	f, err = newIPFragmenter(32, "reverse", false)
+	require.Nil(t, err)
+	frags, err = f.fragment(pkt)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(frags))
+	require.Equal(t, pkt[len(pkt)-24:], frags[0][20:])
+
+	// packets that fit are not fragmented
+	f, err = newIPFragmenter(128, "forward", false)
+	require.Nil(t, err)
+	frags, err = f.fragment(pkt)
+	require.Nil(t, err)
+	require.Equal(t, [][]byte{pkt}, frags)
+}
+
+func TestFragmentIPv6(t *testing.T) {
+	ipLayer := &layers.IPv6{
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolUDP,
+	}
+	payload := bytes.Repeat([]byte("abcdefgh"), 10)
+	pkt := testUDPPacket(t, ipLayer, payload)
+
+	f, err := newIPFragmenter(40, "forward", false)
+	require.Nil(t, err)
+
+	frags, err := f.fragment(pkt)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(frags))
+
+	var reassembled []byte
+	var id uint32
+	for i, frag := range frags {
+		p := gopacket.NewPacket(frag, layers.LayerTypeIPv6, gopacket.Default)
+		ip6 := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+		require.Equal(t, layers.IPProtocolIPv6Fragment, ip6.NextHeader)
+		require.Equal(t, int(ip6.Length), len(frag)-40)
+
+		fragLayer := p.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment)
+		require.Equal(t, layers.IPProtocolUDP, fragLayer.NextHeader)
+		require.Equal(t, uint16(len(reassembled)/8), fragLayer.FragmentOffset)
+		require.Equal(t, i < len(frags)-1, fragLayer.MoreFragments)
+		if i == 0 {
+			id = fragLayer.Identification
+		}
+		require.Equal(t, id, fragLayer.Identification)
+
+		reassembled = append(reassembled, frag[48:]...)
+	}
+	require.Equal(t, pkt[40:], reassembled)
+}
+
+func TestFragmenterConfig(t *testing.T) {
+	f, err := newIPFragmenter(0, "forward", false)
+	require.Nil(t, err)
+	require.Nil(t, f)
+
+	_, err = newIPFragmenter(12, "forward", false)
+	require.NotNil(t, err)
+
+	_, err = newIPFragmenter(16, "sideways", false)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+const h2cProbeTypeName = "h2c"
+
+const h2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// HTTP/2 frame types and flags (RFC 9113 section 6)
+const (
+	h2FrameHeaders  = 0x1
+	h2FrameSettings = 0x4
+
+	h2FlagEndStream  = 0x1
+	h2FlagEndHeaders = 0x4
+)
+
+// h2Settings are sent in the client SETTINGS frame, matching Chrome.
+var h2Settings = []struct {
+	id  uint16
+	val uint32
+}{
+	{0x1, 65536},   // HEADER_TABLE_SIZE
+	{0x2, 0},       // ENABLE_PUSH
+	{0x4, 6291456}, // INITIAL_WINDOW_SIZE
+	{0x6, 262144},  // MAX_HEADER_LIST_SIZE
+}
+
+// h2cProber sends an HTTP/2 cleartext request with prior knowledge (the
+// connection preface, SETTINGS, and a HEADERS frame) to port 80. The tested
+// domain is only present as the HPACK encoded :authority, so censors that
+// only parse the HTTP/1.1 Host header will miss it.
+type h2cProber struct {
+	sender *tcpSender
+
+	dkt *KeyTable
+
+	// rawHPACK encodes header strings as plain literals instead of Huffman
+	// coding them so that the domain appears in the clear.
+	rawHPACK bool
+
+	outDir      string
+	CaptureICMP bool
+}
+
+func (p *h2cProber) registerFlags() {
+	flag.BoolVar(&p.rawHPACK, "h2c-raw-hpack", false, "[H2C] Send HPACK header strings as plain literals instead of Huffman coded")
+}
+
+func (p *h2cProber) sendProbe(ip net.IP, name string, verbose bool) error {
+	laddr, addr, err := p.sendTrigger(ip, name, verbose)
+	if err != nil {
+		return err
+	}
+	return p.sender.sendResidual(laddr, addr, name, p.buildPayload, verbose)
+}
+
+// sendTrigger sends the probe without scheduling residual control probes.
+func (p *h2cProber) sendTrigger(ip net.IP, name string, verbose bool) (string, string, error) {
+
+	out, err := p.buildPayload(name)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to build h2c payload: %s", err)
+	}
+
+	sport, _ := p.dkt.get(name)
+
+	addr := net.JoinHostPort(ip.String(), "80")
+	seqAck, laddr, err := p.sender.sendTCP(addr, sport.(int), name, out, verbose)
+	if err != nil {
+		return "", "", err
+	} else if verbose {
+		log.Printf("Sent %s -> %s %s %s %s\n", laddr, addr, name, seqAck, p.sender.timing())
+	}
+
+	return laddr, addr, nil
+}
+
+// buildPayload builds the connection preface followed by a SETTINGS frame
+// and a HEADERS frame for a GET of / on stream 1.
+func (p *h2cProber) buildPayload(name string) ([]byte, error) {
+	headers := []hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":authority", Value: name},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: "user-agent", Value: httpUserAgent},
+		{Name: "accept", Value: "*/*"},
+	}
+
+	var block []byte
+	if p.rawHPACK {
+		block = appendRawHPACK(nil, headers)
+	} else {
+		var buf bytes.Buffer
+		enc := hpack.NewEncoder(&buf)
+		for _, hf := range headers {
+			if err := enc.WriteField(hf); err != nil {
+				return nil, err
+			}
+		}
+		block = buf.Bytes()
+	}
+
+	var settings []byte
+	for _, s := range h2Settings {
+		settings = binary.BigEndian.AppendUint16(settings, s.id)
+		settings = binary.BigEndian.AppendUint32(settings, s.val)
+	}
+
+	out := []byte(h2Preface)
+	out = appendH2Frame(out, h2FrameSettings, 0, 0, settings)
+	out = appendH2Frame(out, h2FrameHeaders, h2FlagEndStream|h2FlagEndHeaders, 1, block)
+	return out, nil
+}
+
+func (p *h2cProber) handlePcap(iface string, exit chan struct{}, wg *sync.WaitGroup) {
+	pcapName := h2cProbeTypeName + ".pcap"
+	bpfFilter := "tcp src port 80"
+
+	pcapPath := filepath.Join(p.outDir, pcapName)
+
+	if p.CaptureICMP {
+		bpfFilter = "icmp or icmp6 or " + bpfFilter
+	}
+	capturePcap(iface, pcapPath, bpfFilter, exit, wg)
+}
+
+// appendH2Frame appends an HTTP/2 frame with a 9 byte header to dst.
+func appendH2Frame(dst []byte, typ, flags byte, streamID uint32, payload []byte) []byte {
+	dst = append(dst, byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)), typ, flags)
+	dst = binary.BigEndian.AppendUint32(dst, streamID&0x7fffffff)
+	return append(dst, payload...)
+}
+
+// appendRawHPACK encodes headers as literal header fields without indexing
+// (RFC 7541 section 6.2.2) with plain (not Huffman coded) strings, using the
+// static table for names where possible.
+func appendRawHPACK(dst []byte, headers []hpack.HeaderField) []byte {
+	for _, hf := range headers {
+		if i, ok := hpackStaticNames[hf.Name]; ok {
+			dst = appendHPACKInt(dst, 4, uint64(i))
+		} else {
+			dst = append(dst, 0x00)
+			dst = appendHPACKInt(dst, 7, uint64(len(hf.Name)))
+			dst = append(dst, hf.Name...)
+		}
+		dst = appendHPACKInt(dst, 7, uint64(len(hf.Value)))
+		dst = append(dst, hf.Value...)
+	}
+	return dst
+}
+
+// hpackStaticNames are the static table indexes of the header names sent.
+var hpackStaticNames = map[string]int{
+	":authority": 1,
+	":method":    2,
+	":path":      4,
+	":scheme":    6,
+	"accept":     19,
+	"user-agent": 58,
+}
+
+// appendHPACKInt appends i encoded as an HPACK integer with an n bit prefix
+// (RFC 7541 section 5.1) and the bits above the prefix unset.
+func appendHPACKInt(dst []byte, n uint, i uint64) []byte {
+	max := uint64(1)<<n - 1
+	if i < max {
+		return append(dst, byte(i))
+	}
+	dst = append(dst, byte(max))
+	i -= max
+	for i >= 128 {
+		dst = append(dst, byte(i%128)|0x80)
+		i /= 128
+	}
+	return append(dst, byte(i))
+}
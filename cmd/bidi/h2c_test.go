@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestH2CPayload(t *testing.T) {
+	for _, raw := range []bool{false, true} {
+		p := &h2cProber{rawHPACK: raw}
+		out, err := p.buildPayload("example.com")
+		require.Nil(t, err)
+
+		require.True(t, strings.HasPrefix(string(out), h2Preface))
+		out = out[len(h2Preface):]
+
+		// SETTINGS
+		n := int(out[0])<<16 | int(out[1])<<8 | int(out[2])
+		require.Equal(t, byte(h2FrameSettings), out[3])
+		require.Equal(t, len(h2Settings)*6, n)
+		require.Equal(t, uint32(0), binary.BigEndian.Uint32(out[5:]))
+		out = out[9+n:]
+
+		// HEADERS
+		n = int(out[0])<<16 | int(out[1])<<8 | int(out[2])
+		require.Equal(t, byte(h2FrameHeaders), out[3])
+		require.Equal(t, byte(h2FlagEndStream|h2FlagEndHeaders), out[4])
+		require.Equal(t, uint32(1), binary.BigEndian.Uint32(out[5:]))
+		require.Equal(t, 9+n, len(out))
+
+		block := out[9:]
+		require.Equal(t, raw, strings.Contains(string(block), "example.com"))
+
+		fields, err := hpack.NewDecoder(4096, nil).DecodeFull(block)
+		require.Nil(t, err)
+		headers := make(map[string]string)
+		for _, hf := range fields {
+			headers[hf.Name] = hf.Value
+		}
+		require.Equal(t, "example.com", headers[":authority"])
+		require.Equal(t, "GET", headers[":method"])
+		require.Equal(t, httpUserAgent, headers["user-agent"])
+	}
+}
+
+func TestHPACKInt(t *testing.T) {
+	// RFC 7541 appendix C.1
+	require.Equal(t, []byte{0x0a}, appendHPACKInt(nil, 5, 10))
+	require.Equal(t, []byte{0x1f, 0x9a, 0x0a}, appendHPACKInt(nil, 5, 1337))
+	require.Equal(t, []byte{0x2a}, appendHPACKInt(nil, 8, 42))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// synAckFilter matches TCP packets with both the SYN and ACK flags set for
+// IPv4 and for IPv6 packets without extension headers.
+const synAckFilter = "(ip and tcp[13] & 0x12 == 0x12) or (ip6 and ip6[6] == 6 and ip6[53] & 0x12 == 0x12)"
+
+// handshakeTracker watches the capture interface for the SYN-ACKs sent in
+// response to our SYNs so that probes can be sent on genuine TCP connections
+// (with the correct ack number) rather than blindly injected.
+//
+// The kernel has no socket for these connections and will answer each SYN-ACK
+// with a RST unless that is suppressed, e.g. for a source port range:
+//
+//	iptables -A OUTPUT -p tcp --tcp-flags RST RST --sport 1000:65535 -j DROP
+type handshakeTracker struct {
+	timeout time.Duration
+
+	// pending maps the (local, remote) address pair of each SYN awaiting a
+	// SYN-ACK to the channel its initial sequence number is delivered on.
+	pending map[string]chan uint32
+	mu      sync.Mutex
+
+	// teardowns tracks the rsts scheduled to tear down genuine connections
+	// so that they are sent before exit.
+	teardowns sync.WaitGroup
+
+	handle *pcap.Handle
+}
+
+// newHandshakeTracker opens a capture on device for SYN-ACKs. SYN-ACKs are
+// waited on for at most timeout.
+func newHandshakeTracker(device string, timeout time.Duration) (*handshakeTracker, error) {
+	handle, err := pcap.OpenLive(device, 1600, false, pcap.BlockForever)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open syn-ack capture: %s", err)
+	}
+	if err := handle.SetBPFFilter(synAckFilter); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("failed to set syn-ack filter: %s", err)
+	}
+
+	h := &handshakeTracker{
+		timeout: timeout,
+		pending: make(map[string]chan uint32),
+		handle:  handle,
+	}
+
+	go func() {
+		packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+		for packet := range packetSource.Packets() {
+			h.handlePacket(packet)
+		}
+	}()
+
+	return h, nil
+}
+
+func handshakeKey(local net.IP, lport int, remote net.IP, rport int) string {
+	return net.JoinHostPort(local.String(), strconv.Itoa(lport)) + "-" + net.JoinHostPort(remote.String(), strconv.Itoa(rport))
+}
+
+// expect registers interest in the SYN-ACK for a SYN about to be sent. The
+// returned key must be passed to wait.
+func (h *handshakeTracker) expect(local net.IP, lport int, remote net.IP, rport int) string {
+	key := handshakeKey(local, lport, remote, rport)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending[key] = make(chan uint32, 1)
+	return key
+}
+
+// wait blocks until the SYN-ACK for key is observed and returns the remote
+// initial sequence number, or returns an error on timeout.
+func (h *handshakeTracker) wait(key string) (uint32, error) {
+	h.mu.Lock()
+	c, ok := h.pending[key]
+	h.mu.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("no syn sent for %s", key)
+	}
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.pending, key)
+		h.mu.Unlock()
+	}()
+
+	select {
+	case isn := <-c:
+		return isn, nil
+	case <-time.After(h.timeout):
+		return 0, fmt.Errorf("no syn-ack for %s after %s", key, h.timeout)
+	}
+}
+
+// teardown calls send, which sends the rst tearing down a genuine connection,
+// once the server has had timeout to respond to the data.
+func (h *handshakeTracker) teardown(send func()) {
+	h.teardowns.Add(1)
+	time.AfterFunc(h.timeout, func() {
+		defer h.teardowns.Done()
+		send()
+	})
+}
+
+// waitTeardowns blocks until all scheduled rsts have been sent.
+func (h *handshakeTracker) waitTeardowns() {
+	if h == nil {
+		return
+	}
+	h.teardowns.Wait()
+}
+
+func (h *handshakeTracker) handlePacket(packet gopacket.Packet) {
+	var local, remote net.IP
+	if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+		ip4, _ := ipLayer.(*layers.IPv4)
+		local, remote = ip4.DstIP, ip4.SrcIP
+	} else if ipLayer := packet.Layer(layers.LayerTypeIPv6); ipLayer != nil {
+		ip6, _ := ipLayer.(*layers.IPv6)
+		local, remote = ip6.DstIP, ip6.SrcIP
+	} else {
+		return
+	}
+
+	tcpLayer := packet.Layer(layers.LayerTypeTCP)
+	if tcpLayer == nil {
+		return
+	}
+	tcp, _ := tcpLayer.(*layers.TCP)
+	if !tcp.SYN || !tcp.ACK {
+		return
+	}
+
+	key := handshakeKey(local, int(tcp.DstPort), remote, int(tcp.SrcPort))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c, ok := h.pending[key]; ok {
+		select {
+		case c <- tcp.Seq:
+		default:
+			// retransmitted syn-ack, the first is already queued
+		}
+	}
+}
+
+func (h *handshakeTracker) close() {
+	if h == nil {
+		return
+	}
+	h.handle.Close()
+	log.Println("Closing syn-ack handler")
+}
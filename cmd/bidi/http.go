@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net"
@@ -21,34 +22,120 @@ type httpProber struct {
 
 	dkt *KeyTable
 
+	// templates are the requests sent for each probe, in order
+	templatePath string
+	templates    []httpTemplate
+
 	outDir      string
 	CaptureICMP bool
 }
 
 func (p *httpProber) registerFlags() {
+	flag.StringVar(&p.templatePath, "http-templates", "", "[HTTP] JSON file of named request templates to send for each probe (see http_templates.json). Empty sends a single GET")
 }
 
-func (p *httpProber) buildPayload(name string) ([]byte, error) {
-	// Fill out request bytes
-	return []byte(fmt.Sprintf(httpFmtStr, name, httpUserAgent)), nil
+// loadTemplates loads the request templates. It must be called after flags
+// are parsed.
+func (p *httpProber) loadTemplates() error {
+	if p.templatePath == "" {
+		p.templates = []httpTemplate{defaultHTTPTemplate}
+		return nil
+	}
 
+	templates, err := loadHTTPTemplates(p.templatePath)
+	if err != nil {
+		return err
+	}
+	p.templates = templates
+	return nil
 }
 
+// buildPayload builds the request of the first template.
+func (p *httpProber) buildPayload(name string) ([]byte, error) {
+	if len(p.templates) == 0 {
+		return defaultHTTPTemplate.build(name), nil
+	}
+	return p.templates[0].build(name), nil
+}
+
+// sendProbe sends the request of each template in turn, each on a new
+// connection from the template's own source port (see templatePort). The
+// template name and sequence numbers of each request are recorded in the send
+// log so that responses can be attributed to the variant that triggered them.
 func (p *httpProber) sendProbe(ip net.IP, name string, verbose bool) error {
-	out, err := p.buildPayload(name)
+	laddr, addr, err := p.sendTrigger(ip, name, verbose)
 	if err != nil {
-		return fmt.Errorf("failed to build tls payload: %s", err)
+		return err
 	}
+	return p.sender.sendResidual(laddr, addr, name, p.buildPayload, verbose)
+}
 
-	sport, _ := p.dkt.get(name)
+// sendTrigger sends the probe without scheduling residual control probes.
+func (p *httpProber) sendTrigger(ip net.IP, name string, verbose bool) (string, string, error) {
+	templates := p.templates
+	if len(templates) == 0 {
+		templates = []httpTemplate{defaultHTTPTemplate}
+	}
 
 	addr := net.JoinHostPort(ip.String(), "80")
-	seqAck, sport, err := p.sender.sendTCP(addr, sport.(int), name, out, verbose)
-	if err == nil && verbose {
-		log.Printf("Sent :%d -> %s %s %s\n", sport, addr, name, seqAck)
+
+	// residual probes follow up on the first template, sent from the domain's
+	// own source port
+	var laddr string
+	for i, t := range templates {
+		sport, err := p.templatePort(name, i, t)
+		if err != nil {
+			return "", "", fmt.Errorf("template %s: %s", t.Name, err)
+		}
+		out := t.build(name)
+
+		seqAck, l, err := p.sender.sendTCP(addr, sport, name, out, verbose)
+		if err != nil {
+			return "", "", fmt.Errorf("template %s: %s", t.Name, err)
+		} else if verbose {
+			log.Printf("Sent %s -> %s %s %s %s %s\n", l, addr, name, t.Name, seqAck, p.sender.timing())
+		}
+		if i == 0 {
+			laddr = l
+		}
 	}
 
-	return err
+	return laddr, addr, nil
+}
+
+// templateKey returns the domain key table key of the ith template. The first
+// template uses the domain's own key, every other template gets its own key
+// (and so its own source port) "<domain>#<template>", so residual censorship
+// triggered by one template does not block the templates sent after it, and
+// responses are attributed by port.
+func templateKey(name string, i int, t httpTemplate) string {
+	if i == 0 {
+		return name
+	}
+	return name + "#" + t.Name
+}
+
+// templateKeys returns the domain key table keys of every template for each
+// of the domains. It must be called after loadTemplates.
+func (p *httpProber) templateKeys(domains []string) []string {
+	keys := make([]string, 0, len(domains)*len(p.templates))
+	for _, d := range domains {
+		for i, t := range p.templates {
+			keys = append(keys, templateKey(d, i, t))
+		}
+	}
+	return keys
+}
+
+// templatePort returns the source port the ith template is sent from. The
+// ports are allocated up front by createDomainKeyTable from templateKeys.
+func (p *httpProber) templatePort(name string, i int, t httpTemplate) (int, error) {
+	key := templateKey(name, i, t)
+	sport, ok := p.dkt.get(key)
+	if !ok {
+		return 0, fmt.Errorf("no source port for %s", key)
+	}
+	return sport.(int), nil
 }
 
 func (p *httpProber) handlePcap(iface string, exit chan struct{}, wg *sync.WaitGroup) {
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// httpTemplate is a named HTTP request with placeholders that are filled in
+// for each probe:
+//
+//	{{domain}}      the tested domain
+//	{{user_agent}}  httpUserAgent
+type httpTemplate struct {
+	Name    string `json:"name"`
+	Request string `json:"request"`
+}
+
+// defaultHTTPTemplate is the request sent when no template file is given.
+var defaultHTTPTemplate = httpTemplate{
+	Name:    "default",
+	Request: fmt.Sprintf(httpFmtStr, "{{domain}}", "{{user_agent}}"),
+}
+
+// build fills in the placeholders of the template for name.
+func (t httpTemplate) build(name string) []byte {
+	r := strings.NewReplacer("{{domain}}", name, "{{user_agent}}", httpUserAgent)
+	return []byte(r.Replace(t.Request))
+}
+
+// loadHTTPTemplates reads a JSON list of named request templates, e.g.
+//
+//	[{"name": "head", "request": "HEAD / HTTP/1.1\r\nHost: {{domain}}\r\n\r\n"}]
+func loadHTTPTemplates(path string) ([]httpTemplate, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read http templates: %s", err)
+	}
+
+	var templates []httpTemplate
+	if err := json.Unmarshal(b, &templates); err != nil {
+		return nil, fmt.Errorf("failed to parse http templates \"%s\": %s", path, err)
+	} else if len(templates) == 0 {
+		return nil, fmt.Errorf("no http templates in \"%s\"", path)
+	}
+
+	names := make(map[string]bool)
+	for _, t := range templates {
+		if t.Name == "" || strings.ContainsAny(t.Name, " \t\r\n") {
+			return nil, fmt.Errorf("bad http template name \"%s\" - names must be non-empty with no whitespace", t.Name)
+		} else if names[t.Name] {
+			return nil, fmt.Errorf("duplicate http template name \"%s\"", t.Name)
+		} else if t.Request == "" {
+			return nil, fmt.Errorf("http template \"%s\" has an empty request", t.Name)
+		}
+		names[t.Name] = true
+	}
+
+	return templates, nil
+}
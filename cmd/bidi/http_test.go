@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPDefaultTemplate(t *testing.T) {
+	p := &httpProber{}
+	require.Nil(t, p.loadTemplates())
+
+	out, err := p.buildPayload("example.com")
+	require.Nil(t, err)
+	require.Equal(t, fmt.Sprintf(httpFmtStr, "example.com", httpUserAgent), string(out))
+}
+
+func TestHTTPTemplates(t *testing.T) {
+	p := &httpProber{templatePath: "http_templates.json"}
+	require.Nil(t, p.loadTemplates())
+	require.Equal(t, "get", p.templates[0].Name)
+
+	for _, tmpl := range p.templates {
+		out := string(tmpl.build("example.com"))
+		require.NotContains(t, out, "{{", tmpl.Name)
+		require.Contains(t, out, "example.com", tmpl.Name)
+		require.True(t, strings.HasSuffix(out, "\n\n") || strings.HasSuffix(out, "\r\n\r\n"), tmpl.Name)
+	}
+
+	dir := t.TempDir()
+	for _, bad := range []string{
+		`[]`,
+		`[{"name": "", "request": "GET / HTTP/1.1\r\n\r\n"}]`,
+		`[{"name": "a b", "request": "GET / HTTP/1.1\r\n\r\n"}]`,
+		`[{"name": "a", "request": ""}]`,
+		`[{"name": "a", "request": "x"}, {"name": "a", "request": "y"}]`,
+		`{`,
+	} {
+		path := filepath.Join(dir, "templates.json")
+		require.Nil(t, os.WriteFile(path, []byte(bad), 0666))
+		_, err := loadHTTPTemplates(path)
+		require.NotNil(t, err, bad)
+	}
+}
+
+func TestHTTPTemplatePorts(t *testing.T) {
+	p := &httpProber{templatePath: "http_templates.json"}
+	require.Nil(t, p.loadTemplates())
+	templates := p.templates
+
+	dkt, err := createDomainKeyTable(p.templateKeys([]string{"example.com", "example.org"}))
+	require.Nil(t, err)
+	p.dkt = dkt
+
+	domainPort, _ := dkt.get("example.com")
+	ports := make(map[int]string)
+	for i, tmpl := range templates {
+		sport, err := p.templatePort("example.com", i, tmpl)
+		require.Nil(t, err)
+		if i == 0 {
+			require.Equal(t, domainPort, sport)
+		}
+
+		// each template has its own port, stable across probes
+		_, dup := ports[sport]
+		require.False(t, dup, tmpl.Name)
+		ports[sport] = tmpl.Name
+		again, err := p.templatePort("example.com", i, tmpl)
+		require.Nil(t, err)
+		require.Equal(t, sport, again)
+
+		key, ok := dkt.getKey(sport)
+		require.True(t, ok)
+		if i > 0 {
+			require.Equal(t, "example.com#"+tmpl.Name, key)
+		}
+	}
+
+	otherPort, _ := dkt.get("example.org")
+	_, dup := ports[otherPort.(int)]
+	require.False(t, dup)
+
+	// every template key is in the key table written at startup
+	b, err := json.Marshal(dkt)
+	require.Nil(t, err)
+	var dump struct{ F map[string]int }
+	require.Nil(t, json.Unmarshal(b, &dump))
+	require.Equal(t, 2*len(templates), len(dump.F))
+	require.Contains(t, dump.F, "example.org#"+templates[len(templates)-1].Name)
+
+	// an unknown key is an error rather than a new port
+	_, err = p.templatePort("example.net", 1, templates[1])
+	require.NotNil(t, err)
+
+	_, err = createDomainKeyTable(make([]string, domainKeyPorts+1))
+	require.NotNil(t, err)
+}
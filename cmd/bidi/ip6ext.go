@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// ipv6ExtHeader describes an IPv6 extension header to be inserted between the
+// IPv6 header and the transport header of probe packets. Middle-boxes that do
+// not walk the extension header chain will fail to find the payload.
+//
+// Hop-by-Hop and Destination Options headers are filled with padding options.
+// Routing headers are type 0 with segments left set to 0 so that no node ever
+// forwards based on them (the addresses are left as zeros).
+type ipv6ExtHeader struct {
+	proto layers.IPProtocol
+	size  int
+}
+
+var ipv6ExtHeaderNames = map[string]layers.IPProtocol{
+	"hbh": layers.IPProtocolIPv6HopByHop,
+	"dst": layers.IPProtocolIPv6Destination,
+	"rt":  layers.IPProtocolIPv6Routing,
+}
+
+// parseIPv6ExtHeaders parses a comma separated list of extension headers in
+// the form "name:size" (e.g. "hbh:8,dst:16,rt:24"), where name is one of hbh,
+// dst, or rt and size is the length of the header in bytes. Headers are
+// inserted in the order given. If size is omitted the minimum size is used.
+func parseIPv6ExtHeaders(spec string) ([]ipv6ExtHeader, error) {
+	var exts []ipv6ExtHeader
+	if spec == "" || spec == "none" {
+		return exts, nil
+	}
+
+	for _, e := range strings.Split(spec, ",") {
+		name, sizeStr, hasSize := strings.Cut(strings.TrimSpace(e), ":")
+		proto, ok := ipv6ExtHeaderNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown ipv6 extension header \"%s\" - must be one of hbh, dst, rt", name)
+		}
+
+		size := 8
+		if hasSize {
+			var err error
+			size, err = strconv.Atoi(sizeStr)
+			if err != nil {
+				return nil, fmt.Errorf("bad ipv6 extension header size \"%s\": %s", sizeStr, err)
+			}
+		}
+
+		if size < 8 || size%8 != 0 || size > 2048 {
+			return nil, fmt.Errorf("ipv6 extension header size must be a multiple of 8 between 8 and 2048")
+		} else if proto == layers.IPProtocolIPv6Routing && (size-8)%16 != 0 {
+			return nil, fmt.Errorf("ipv6 routing header size must be 8 + 16*N")
+		}
+
+		exts = append(exts, ipv6ExtHeader{proto: proto, size: size})
+	}
+
+	return exts, nil
+}
+
+// withIPv6ExtHeaders inserts the extension headers directly after the IPv6
+// header of the serialized packet. Non IPv6 packets are returned unmodified.
+// Upper layer checksums do not cover extension headers so they stay valid.
+func withIPv6ExtHeaders(pkt []byte, exts []ipv6ExtHeader) ([]byte, error) {
+	if len(exts) == 0 || len(pkt) < 1 || pkt[0]>>4 != 6 {
+		return pkt, nil
+	}
+	if len(pkt) < 40 {
+		return nil, fmt.Errorf("malformed ipv6 packet")
+	}
+
+	extLen := 0
+	for _, e := range exts {
+		extLen += e.size
+	}
+
+	out := make([]byte, len(pkt)+extLen)
+	copy(out, pkt[:40])
+	copy(out[40+extLen:], pkt[40:])
+
+	upperProto := pkt[6]
+	out[6] = byte(exts[0].proto)
+	binary.BigEndian.PutUint16(out[4:], uint16(len(out)-40))
+
+	offset := 40
+	for i, e := range exts {
+		h := out[offset : offset+e.size]
+		if i < len(exts)-1 {
+			h[0] = byte(exts[i+1].proto)
+		} else {
+			h[0] = upperProto
+		}
+		h[1] = byte(e.size/8 - 1)
+
+		switch e.proto {
+		case layers.IPProtocolIPv6Routing:
+			h[2] = 0 // routing type 0
+			h[3] = 0 // segments left
+		default:
+			// fill the options area with PadN options (or Pad1 if there is
+			// only a single byte left).
+			for j := 2; j < e.size; {
+				pad := e.size - j
+				if pad == 1 {
+					h[j] = 0
+					break
+				} else if pad > 257 {
+					pad = 257
+				}
+				h[j] = 1
+				h[j+1] = byte(pad - 2)
+				j += pad
+			}
+		}
+		offset += e.size
+	}
+
+	return out, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPv6ExtHeaders(t *testing.T) {
+	ipLayer := &layers.IPv6{
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolUDP,
+	}
+	payload := []byte("abcdefgh")
+	pkt := testUDPPacketTo(t, ipLayer, 4444, payload)
+
+	exts, err := parseIPv6ExtHeaders("hbh:8,dst:600,rt:24")
+	require.Nil(t, err)
+	require.Equal(t, 3, len(exts))
+
+	out, err := withIPv6ExtHeaders(pkt, exts)
+	require.Nil(t, err)
+	require.Equal(t, len(pkt)+8+600+24, len(out))
+
+	p := gopacket.NewPacket(out, layers.LayerTypeIPv6, gopacket.Default)
+	require.Nil(t, p.ErrorLayer())
+
+	ip6 := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	require.Equal(t, int(ip6.Length), len(out)-40)
+
+	hbh := p.Layer(layers.LayerTypeIPv6HopByHop).(*layers.IPv6HopByHop)
+	require.Equal(t, layers.IPProtocolIPv6Destination, hbh.NextHeader)
+
+	dst := p.Layer(layers.LayerTypeIPv6Destination).(*layers.IPv6Destination)
+	require.Equal(t, layers.IPProtocolIPv6Routing, dst.NextHeader)
+	require.Equal(t, 600, len(dst.Contents))
+
+	rt := p.Layer(layers.LayerTypeIPv6Routing).(*layers.IPv6Routing)
+	require.Equal(t, layers.IPProtocolUDP, rt.NextHeader)
+	require.Equal(t, uint8(0), rt.SegmentsLeft)
+
+	udp := p.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	require.True(t, bytes.Equal(payload, udp.Payload))
+
+	// the udp checksum is unaffected by the extension headers
+	require.Equal(t, pkt[len(pkt)-len(payload)-8:], out[len(out)-len(payload)-8:])
+
+	// extension headers are left in the unfragmentable part on fragmentation
+	f, err := newIPFragmenter(8, "forward", false)
+	require.Nil(t, err)
+	frags, err := f.fragment(out)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(frags))
+	p = gopacket.NewPacket(frags[0], layers.LayerTypeIPv6, gopacket.Default)
+	require.NotNil(t, p.Layer(layers.LayerTypeIPv6HopByHop))
+	require.NotNil(t, p.Layer(layers.LayerTypeIPv6Routing))
+	fragLayer := p.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment)
+	require.Equal(t, layers.IPProtocolUDP, fragLayer.NextHeader)
+
+	// ipv4 packets are not modified
+	ip4 := testUDPPacketTo(t, &layers.IPv4{
+		SrcIP:    net.ParseIP("192.168.0.1"),
+		DstIP:    net.ParseIP("192.168.0.2"),
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+	}, 4444, payload)
+	out, err = withIPv6ExtHeaders(ip4, exts)
+	require.Nil(t, err)
+	require.Equal(t, ip4, out)
+}
+
+func TestParseIPv6ExtHeaders(t *testing.T) {
+	exts, err := parseIPv6ExtHeaders("")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(exts))
+
+	exts, err = parseIPv6ExtHeaders("dst")
+	require.Nil(t, err)
+	require.Equal(t, 8, exts[0].size)
+
+	for _, bad := range []string{"foo:8", "hbh:12", "hbh:0", "rt:16", "dst:x", "hbh:4096"} {
+		_, err = parseIPv6ExtHeaders(bad)
+		require.NotNil(t, err, bad)
+	}
+}
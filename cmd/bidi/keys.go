@@ -116,6 +116,9 @@ func (t *KeyTable) marshal(w io.Writer) error {
 }
 
 func (t *KeyTable) MarshalJSON() ([]byte, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
 	m := struct {
 		F map[string]int
 		R map[int]string
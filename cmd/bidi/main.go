@@ -20,22 +20,54 @@ type prober interface {
 	handlePcap(iface string, exit chan struct{}, wg *sync.WaitGroup)
 }
 
+// triggerProber is implemented by probers that follow each probe with residual
+// control probes (see residualScheduler). sendTrigger sends the probe without
+// scheduling them and returns the local and remote address it was sent
+// between, so that fresh repeats of a probe are followed by a single set of
+// control probes after the last repeat.
+type triggerProber interface {
+	sendTrigger(ip net.IP, name string, verbose bool) (string, string, error)
+}
+
 type job struct {
 	domain string
 	ip     string
 }
 
-func worker(p prober, wait time.Duration, verbose bool, ips <-chan *job, wg *sync.WaitGroup) {
+func worker(p prober, wait time.Duration, repeat *probeRepeat, verbose bool, ips <-chan *job, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	for job := range ips {
 		addr := net.ParseIP(job.ip)
-		err := p.sendProbe(addr, job.domain, verbose)
+
+		// residual control probes are only scheduled after the last probe
+		n := repeat.probes()
+		sent := 0
+		send := func() error {
+			sent++
+			if t, ok := p.(triggerProber); ok && sent < n {
+				_, _, err := t.sendTrigger(addr, job.domain, verbose)
+				return err
+			}
+			return p.sendProbe(addr, job.domain, verbose)
+		}
+
+		err := send()
+		scanProgress.incDone()
 		if err != nil {
 			log.Printf("Result %s,%s - error: %v\n", job.ip, job.domain, err)
 			continue
 		}
 
+		// send fresh repeats of the probe if enabled
+		if n > 1 {
+			err = retransmit(n-1, repeat.interval, send)
+			if err != nil {
+				log.Printf("Result %s,%s - repeat error: %v\n", job.ip, job.domain, err)
+				continue
+			}
+		}
+
 		// Wait here
 		time.Sleep(wait)
 	}
@@ -88,14 +120,20 @@ func getIPs(fPath string) ([]string, error) {
 
 func main() {
 
+	// dns over udp and tcp share query options
+	dnsQuery := &dnsProber{}
+
 	var probers = map[string]prober{
-		dnsProbeTypeName:  &dnsProber{},
-		httpProbeTypeName: &httpProber{},
-		tlsProbeTypeName:  &tlsProber{},
-		esniProbeTypeName: &echProber{esni: true, send1_3: true},
-		echProbeTypeName:  &echProber{ech: true, send1_3: true},
-		quicProbeTypeName: &quicProber{},
-		dtlsProbeTypeName: &dtlsProber{},
+		dnsProbeTypeName:    dnsQuery,
+		dnsTCPProbeTypeName: &dnsTCPProber{query: dnsQuery},
+		httpProbeTypeName:   &httpProber{},
+		h2cProbeTypeName:    &h2cProber{},
+		tlsProbeTypeName:    &tlsProber{},
+		dotProbeTypeName:    &dotProber{},
+		esniProbeTypeName:   &echProber{esni: true, send1_3: true},
+		echProbeTypeName:    &echProber{ech: true, send1_3: true},
+		quicProbeTypeName:   &quicProber{},
+		dtlsProbeTypeName:   &dtlsProber{},
 	}
 
 	nWorkers := flag.Uint("workers", 50, "Number worker threads")
@@ -104,15 +142,46 @@ func main() {
 	domainf := flag.String("domains", "domains.txt", "File with a list of domains to test")
 	ipFName := flag.String("ips", "", "File with a list of target ip to test. Empty string reads from stdin")
 	iface := flag.String("iface", "eth0", "Interface to listen on")
-	lAddr4 := flag.String("laddr", "", "Local address to send packets from - unset uses default interface")
-	lAddr6 := flag.String("laddr6", "", "Local address to send packets from - unset uses default interface")
+	lAddr4 := flag.String("laddr", "", "Local address(es) to send packets from as a comma separated list of IPs and/or CIDR ranges - unset uses default interface")
+	lAddr6 := flag.String("laddr6", "", "Local IPv6 address(es) to send packets from as a comma separated list of IPs and/or CIDR ranges - unset uses default interface")
+	lAddrAssign := flag.String("laddr-assign", "target", "How source addresses are assigned when multiple are available. target (one address per target) or probe (round robin per probe)")
 	proberType := flag.String("type", "dns", "probe type to send")
 	seed := flag.Int64("seed", -1, "[HTTP/TLS/QUIC/DTLS] seed for random elements of generated packets. default seeded with time.Now.Nano")
 	noSynAck := flag.Bool("nsa", false, "[HTTP/TLS] No Syn Ack (nsa) disable syn, and ack warm up packets for tcp probes")
-	synDelay := flag.Duration("syn-delay", 2*time.Millisecond, "[HTTP/TLS] when syn ack is enabled delay between syn and data")
+	synDelay := flag.Duration("syn-delay", 2*time.Millisecond, "[HTTP/TLS] when syn ack is enabled delay between syn and ack (or between syn and data with -syn-only)")
+	ackDelay := flag.Duration("ack-delay", 0, "[HTTP/TLS] when syn ack is enabled delay between ack and data")
+	dupDelay := flag.Duration("dup-delay", 0, "[HTTP/TLS] send the data packets a second time after this delay. 0 disables duplicate data")
+	synOnly := flag.Bool("syn-only", false, "[HTTP/TLS] send only a syn (no ack) before the data. The data follows the syn after -syn-delay")
 	noChecksums := flag.Bool("no-checksums", false, "[HTTP/TLS] fix checksums on injected packets for TCP protocols")
 	outDir := flag.String("d", "out/", "output directory for log files")
 	captureICMP := flag.Bool("capture-icmp", false, "Capture ICMP in written result pcaps")
+	captureBackend := flag.String("capture", "pcap", "Capture backend for response pcaps. pcap (libpcap) or afpacket (TPACKET_V3 ring buffer)")
+	ringMB := flag.Int("afpacket-ring-mb", 64, "[afpacket] ring buffer size of each capture socket in MB")
+	fanout := flag.Int("afpacket-fanout", 1, "[afpacket] number of capture sockets / goroutines to load balance captured packets across")
+	rotateSize := flag.Int64("pcap-rotate-size", 0, "Start a new pcap segment once the current segment reaches this many MB (compressed). Segments are listed in <type>.index.json. 0 disables size based rotation")
+	rotateInterval := flag.Duration("pcap-rotate-interval", 0, "Start a new pcap segment after this long (e.g. 10m). 0 disables time based rotation")
+	progressInterval := flag.Duration("progress", 10*time.Second, "Interval at which scan progress and ETA are reported on stderr, in the log, and in progress.txt in the output directory. 0 disables progress reporting")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics at http://<addr>/metrics (e.g. \"localhost:9100\"). Empty disables metrics")
+	recordSent := flag.Bool("record-sent", false, "Record every packet sent by raw socket probes in sent.pcap.gz in the output directory")
+	tcpProfileName := flag.String("tcp-profile", "default", "[HTTP/TLS] TCP header profile for syn, ack, and data packets. One of default, linux, windows, macos, bare, or a path to a json profile file")
+	tcpSeg := flag.String("tcp-seg", "none", "[HTTP/TLS] split tcp payloads into segments. One of none, offset:N, domain (split inside the Host header / SNI), equal:N, records (one segment per TLS record)")
+	tcpSegOrder := flag.String("tcp-seg-order", "forward", "[HTTP/TLS] order segments are sent in. forward or reverse")
+	tcpSegOverlap := flag.Int("tcp-seg-overlap", 0, "[HTTP/TLS] number of junk bytes each segment overlaps into the next segment")
+	fragSize := flag.Int("frag-size", 0, "[HTTP/TLS/QUIC/DNS/DTLS] split data packets into IP fragments carrying at most this many bytes of IP payload (multiple of 8). 0 disables fragmentation")
+	fragOrder := flag.String("frag-order", "forward", "[HTTP/TLS/QUIC/DNS/DTLS] order IP fragments are sent in. forward or reverse")
+	fragTinyFirst := flag.Bool("frag-tiny-first", false, "[HTTP/TLS/QUIC/DNS/DTLS] send a first IP fragment carrying only 8 bytes of IP payload")
+	ip6Ext := flag.String("ip6-ext", "", "[HTTP/TLS/QUIC/DNS/DTLS] IPv6 extension headers to insert before the transport header as name:size (e.g. \"hbh:8,dst:16,rt:24\"). names are hbh, dst, rt")
+	stateful := flag.Bool("stateful", false, "[HTTP/TLS/ESNI/ECH] send probes on genuine TCP connections. Waits for the SYN-ACK to each SYN before sending the ack and data, then RSTs the connection. Targets that do not answer are skipped. Requires kernel RSTs to be dropped (see README)")
+	synAckTimeout := flag.Duration("synack-timeout", 2*time.Second, "[HTTP/TLS/ESNI/ECH] with -stateful, how long to wait for a SYN-ACK and for a response before sending the RST")
+	repeatCount := flag.Int("repeat", 1, "Number of times each probe is sent")
+	repeatInterval := flag.Duration("repeat-interval", time.Second, "Delay between repeats of a probe")
+	repeatMode := flag.String("repeat-mode", "identical", "How probes are repeated. identical (retransmit the same packets - same seq, ports, and payload) or fresh (build a new probe with the same source port)")
+	residualDelays := flag.String("residual-delays", "", "[HTTP/TLS/ESNI/ECH] measure residual censorship by sending control probes from the same source address and port at each of these delays after each probe (e.g. \"10s,60s,120s\")")
+	residualControl := flag.String("residual-control", "v4vsv6.com", "[HTTP/TLS/ESNI/ECH] benign domain sent in residual control probes")
+	fingerprintName := flag.String("fingerprint", "", "[TLS/ESNI/ECH/DOT] send the ClientHello of a client profile (chrome, chrome-legacy, firefox, safari, go, curl) generated by client-hello-gen. Empty uses the built in ClientHello")
+	sniVariantName := flag.String("sni-variant", "normal", "[TLS/ESNI/ECH] how the tested domain appears in the ClientHello. One of normal, none (no SNI), trailing-dot, mixed-case, null-pad (name followed by a null byte), double (two server_name entries), first / last (server_name extension placed first / last), padding (no SNI, domain in a padding extension)")
+	tlsRecords := flag.String("tls-records", "none", "[TLS/ESNI/ECH] split the ClientHello across multiple TLS records sent in the same tcp segment (see -tcp-seg records). One of none, offset:N (split the handshake message at byte offset N), domain (split inside the SNI), equal:N")
+	tcpDataFlags := flag.String("tcp-data-flags", "", "[HTTP/TLS] override the TCP flags of data packets (e.g. \"PA\", \"A\", \"FPAU\")")
 
 	for _, p := range probers {
 		p.registerFlags()
@@ -158,7 +227,148 @@ func main() {
 	}
 	log.Printf("Read %d ips\n", len(ips))
 
-	dkt, err := createDomainKeyTable(domains)
+	tcpProf, err := loadTCPProfile(*tcpProfileName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *tcpDataFlags != "" {
+		tcpProf.Data.Flags = *tcpDataFlags
+		if err := tcpProf.Data.parse(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	segmenter, err := parseSegmenter(*tcpSeg, *tcpSegOrder, *tcpSegOverlap)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fragmenter, err := newIPFragmenter(*fragSize, *fragOrder, *fragTinyFirst)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ext6, err := parseIPv6ExtHeaders(*ip6Ext)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var fingerprint *helloTemplate
+	if *fingerprintName != "" {
+		fingerprint, err = loadHelloTemplate(*fingerprintName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Using %s ClientHello fingerprint\n", fingerprint.Name)
+	}
+
+	sni, err := parseSNIVariant(*sniVariantName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	records, err := parseRecordSplitter(*tlsRecords)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	residual, err := newResidualScheduler(*residualDelays, *residualControl)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	repeat, err := newProbeRepeat(*repeatCount, *repeatInterval, *repeatMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Using probe repeat: %s", repeat)
+
+	var srcPerProbe bool
+	switch *lAddrAssign {
+	case "target":
+	case "probe":
+		srcPerProbe = true
+	default:
+		log.Fatalf("unknown source address assignment \"%s\"", *lAddrAssign)
+	}
+
+	// handshake is the syn-ack tracker of the stateful tcp sender, if any.
+	var handshake *handshakeTracker
+	newTCP := func() *tcpSender {
+		t, err := newTCPSender(*iface, *lAddr4, *lAddr6, !*noSynAck, *synDelay, !*noChecksums)
+		if err != nil {
+			log.Fatal(err)
+		}
+		t.profile = tcpProf
+		t.segmenter = segmenter
+		t.fragmenter = fragmenter
+		t.ext6 = ext6
+		t.srcPerProbe = srcPerProbe
+		t.ackDelay = *ackDelay
+		t.dupDelay = *dupDelay
+		t.synOnly = *synOnly
+		t.repeat = repeat
+		t.residual = residual
+		if *stateful {
+			handshake, err = newHandshakeTracker(*iface, *synAckTimeout)
+			if err != nil {
+				log.Fatal(err)
+			}
+			t.handshake = handshake
+			log.Printf("Using stateful handshakes (syn-ack timeout %s)", *synAckTimeout)
+		}
+		log.Printf("Using source addresses v4: %s v6: %s (per %s)", t.src4, t.src6, *lAddrAssign)
+		log.Printf("Residual control probes: %s", residual)
+		log.Printf("Using probe timing: %s", t.timing())
+		return t
+	}
+
+	newUDP := func() *udpSender {
+		u, err := newUDPSender(*iface, *lAddr4, *lAddr6, true, !*noChecksums)
+		if err != nil {
+			log.Fatal(err)
+		}
+		u.fragmenter = fragmenter
+		u.ext6 = ext6
+		u.srcPerProbe = srcPerProbe
+		u.repeat = repeat
+		log.Printf("Using source addresses v4: %s v6: %s (per %s)", u.src4, u.src6, *lAddrAssign)
+		return u
+	}
+
+	switch *captureBackend {
+	case "pcap", "afpacket":
+	default:
+		log.Fatalf("unknown capture backend \"%s\"", *captureBackend)
+	}
+	captureOpts = captureOptions{backend: *captureBackend, ringMB: *ringMB, fanout: *fanout}
+	log.Printf("Using capture backend: %s", *captureBackend)
+
+	if *rotateSize < 0 || *rotateInterval < 0 {
+		log.Fatal("pcap rotation size and interval must not be negative")
+	}
+	pcapRotation = rotation{maxBytes: *rotateSize << 20, maxAge: *rotateInterval}
+	log.Printf("Using pcap rotation: %s", pcapRotation)
+
+	if *recordSent {
+		sentPcap, err = newPcapRecorder(filepath.Join(*outDir, "sent.pcap"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer sentPcap.close()
+	}
+
+	// every http template is sent from its own source port, so all the ports
+	// are allocated before the key table is written.
+	keys := domains
+	if prober, ok := p.(*httpProber); ok {
+		if err := prober.loadTemplates(); err != nil {
+			log.Fatal(err)
+		}
+		keys = prober.templateKeys(domains)
+	}
+
+	dkt, err := createDomainKeyTable(keys)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -178,59 +388,81 @@ func main() {
 
 	switch prober := p.(type) {
 	case *httpProber:
-		t, err := newTCPSender(*iface, *lAddr4, *lAddr6, !*noSynAck, *synDelay, !*noChecksums)
-		if err != nil {
-			log.Fatal(err)
-		}
+		t := newTCP()
+		prober.sender = t
+		prober.dkt = dkt
+		prober.outDir = *outDir
+		prober.CaptureICMP = *captureICMP
+		defer t.clean()
+	case *h2cProber:
+		t := newTCP()
 		prober.sender = t
 		prober.dkt = dkt
 		prober.outDir = *outDir
 		prober.CaptureICMP = *captureICMP
 		defer t.clean()
 	case *tlsProber:
-		t, err := newTCPSender(*iface, *lAddr4, *lAddr6, !*noSynAck, *synDelay, !*noChecksums)
-		if err != nil {
+		if err := sni.checkSplit(segmenter, records); err != nil {
 			log.Fatal(err)
 		}
+		t := newTCP()
 		prober.sender = t
 		prober.dkt = dkt
 		prober.outDir = *outDir
 		prober.CaptureICMP = *captureICMP
+		prober.fingerprint = fingerprint
+		prober.sni = sni
+		prober.records = records
 		defer t.clean()
 	case *echProber:
-		t, err := newTCPSender(*iface, *lAddr4, *lAddr6, !*noSynAck, *synDelay, !*noChecksums)
-		if err != nil {
+		if err := sni.checkSplit(segmenter, records); err != nil {
 			log.Fatal(err)
 		}
+		t := newTCP()
 		prober.sender = t
 		prober.dkt = dkt
 		prober.outDir = *outDir
 		prober.CaptureICMP = *captureICMP
+		prober.fingerprint = fingerprint
+		prober.sni = sni
+		prober.records = records
 		defer t.clean()
-	case *quicProber:
-		u, err := newUDPSender(*iface, *lAddr4, *lAddr6, true, !*noChecksums)
-		if err != nil {
+	case *dotProber:
+		t := newTCP()
+		prober.sender = t
+		prober.dkt = dkt
+		prober.outDir = *outDir
+		prober.CaptureICMP = *captureICMP
+		prober.fingerprint = fingerprint
+		defer t.clean()
+	case *dnsTCPProber:
+		if err := prober.query.parseOptions(); err != nil {
 			log.Fatal(err)
 		}
+		t := newTCP()
+		prober.sender = t
+		prober.dkt = dkt
+		prober.outDir = *outDir
+		prober.CaptureICMP = *captureICMP
+		defer t.clean()
+	case *quicProber:
+		u := newUDP()
 		prober.sender = u
 		prober.dkt = dkt
 		prober.outDir = *outDir
 		prober.CaptureICMP = *captureICMP
 		defer u.clean()
 	case *dnsProber:
-		u, err := newUDPSender(*iface, *lAddr4, *lAddr6, true, !*noChecksums)
-		if err != nil {
+		if err := prober.parseOptions(); err != nil {
 			log.Fatal(err)
 		}
+		u := newUDP()
 		prober.sender = u
 		prober.outDir = *outDir
 		prober.CaptureICMP = *captureICMP
 		defer u.clean()
 	case *dtlsProber:
-		u, err := newUDPSender(*iface, *lAddr4, *lAddr6, true, !*noChecksums)
-		if err != nil {
-			log.Fatal(err)
-		}
+		u := newUDP()
 		prober.sender = u
 		prober.dkt = dkt
 		prober.outDir = *outDir
@@ -249,12 +481,30 @@ func main() {
 	}
 
 	jobs := make(chan *job, *nWorkers*10)
+	nJobs := len(domains) * len(ips)
+	log.Printf("Scanning %d jobs\n", nJobs)
+	scanProgress.begin(*proberType, int64(nJobs), func() int { return len(jobs) })
+
+	progressWg := sync.WaitGroup{}
+	progressExit := make(chan struct{})
+	if *progressInterval > 0 {
+		progressWg.Add(1)
+		go reportProgress(*progressInterval, filepath.Join(*outDir, "progress.txt"), progressExit, &progressWg)
+	}
+
+	if *metricsAddr != "" {
+		addr, err := startMetrics(*metricsAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Serving metrics at http://%s/metrics", addr)
+	}
 	var wg sync.WaitGroup
 
 	for w := uint(0); w < *nWorkers; w++ {
 		wg.Add(1)
 		// go dnsWorker(*wait, *verbose, false, *lAddr, ips, domains, &wg)
-		go worker(p, *wait, *verbose, jobs, &wg)
+		go worker(p, *wait, repeat, *verbose, jobs, &wg)
 	}
 
 	pcapWg := sync.WaitGroup{}
@@ -268,29 +518,52 @@ func main() {
 		for {
 			time.Sleep(5 * time.Second)
 			epochDur := time.Since(epochStart).Milliseconds()
-			log.Printf("stats %d %d %d %d %f %f",
+			capture := captureStats.totals()
+			received := stats.received()
+			stats.mu.Lock()
+			pt, bt, rt, et, ppe, bpe := stats.pt, stats.bt, stats.rt, stats.et, stats.ppe, stats.bpe
+			stats.mu.Unlock()
+			log.Printf("stats %d %d %d %d %d %d %d %d %d %s %d %f %f",
 				time.Since(start).Milliseconds(),
 				epochDur,
-				stats.pt,
-				stats.bt,
-				float64(stats.ppe)*1000/float64(epochDur),
-				float64(stats.bpe)*1000/float64(epochDur))
-
-			stats.epochReset()
+				pt,
+				bt,
+				capture.received,
+				capture.dropped,
+				capture.ifDropped,
+				rt,
+				len(jobs),
+				received,
+				et,
+				float64(ppe)*1000/float64(epochDur),
+				float64(bpe)*1000/float64(epochDur))
+
+			stats.epochReset(epochDur)
 			epochStart = time.Now()
 		}
 	}()
 
-	nJobs := 0
 	for _, domain := range domains {
 		for _, ip := range ips {
 			jobs <- &job{domain: domain, ip: ip}
-			nJobs++
 		}
 	}
 	close(jobs)
 
 	wg.Wait()
+	close(progressExit)
+	progressWg.Wait()
+
+	if residual != nil {
+		// wait for outstanding control probes and give them the same time as
+		// any other probe to draw a response.
+		residual.wait()
+		time.Sleep(*wait)
+	}
+
+	// wait for the rsts tearing down stateful connections so that none are
+	// dropped at exit.
+	handshake.waitTeardowns()
 
 	pcapExit <- struct{}{}
 	close(pcapExit)
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+)
+
+// startMetrics serves Prometheus text format metrics at /metrics on addr.
+// Returns the address listened on (useful if addr has port 0).
+func startMetrics(addr string) (net.Addr, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Printf("metrics server error: %v", err)
+		}
+	}()
+
+	return l.Addr(), nil
+}
+
+// metric writes a single metric family in Prometheus text format.
+func metric(w io.Writer, name, kind, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	fmt.Fprintf(w, "%s %v\n", name, value)
+}
+
+func writeMetrics(w io.Writer) {
+	stats.mu.Lock()
+	pt, bt, rt, et := stats.pt, stats.bt, stats.rt, stats.et
+	pps, bps := stats.pps, stats.bps
+	var received []string
+	for name, classes := range stats.rcv {
+		for class, n := range classes {
+			received = append(received, fmt.Sprintf("bidi_received_packets_total{probe_type=%q,class=%q} %d", name, class, n))
+		}
+	}
+	stats.mu.Unlock()
+	sort.Strings(received)
+
+	metric(w, "bidi_sent_packets_total", "counter", "Packets sent.", pt)
+	metric(w, "bidi_sent_bytes_total", "counter", "Bytes sent.", bt)
+	metric(w, "bidi_send_packets_per_second", "gauge", "Packets sent per second over the last stats epoch.", pps)
+	metric(w, "bidi_send_bytes_per_second", "gauge", "Bytes sent per second over the last stats epoch.", bps)
+	metric(w, "bidi_sendto_retries_total", "counter", "Failed sendto calls that were retried.", rt)
+	metric(w, "bidi_sendto_errors_total", "counter", "Packets that could not be sent after all retries.", et)
+
+	capture := captureStats.totals()
+	metric(w, "bidi_capture_received_total", "counter", "Packets received by the capture handles (kernel counter).", capture.received)
+	metric(w, "bidi_capture_dropped_total", "counter", "Packets dropped by the capture handles for lack of buffer space.", capture.dropped)
+	metric(w, "bidi_capture_if_dropped_total", "counter", "Packets dropped by the capture interface.", capture.ifDropped)
+
+	fmt.Fprintf(w, "# HELP bidi_received_packets_total Responses written to the result pcaps by probe type and class.\n")
+	fmt.Fprintf(w, "# TYPE bidi_received_packets_total counter\n")
+	for _, line := range received {
+		fmt.Fprintln(w, line)
+	}
+
+	progress := scanProgress.snapshot()
+	eta := progress.eta.Seconds()
+	if progress.eta < 0 {
+		eta = -1
+	}
+	fmt.Fprintf(w, "# HELP bidi_jobs_total Jobs (domain, ip pairs) in the scan.\n")
+	fmt.Fprintf(w, "# TYPE bidi_jobs_total gauge\n")
+	fmt.Fprintf(w, "bidi_jobs_total{probe_type=%q} %d\n", progress.probeType, progress.total)
+	fmt.Fprintf(w, "# HELP bidi_jobs_completed_total Jobs completed.\n")
+	fmt.Fprintf(w, "# TYPE bidi_jobs_completed_total counter\n")
+	fmt.Fprintf(w, "bidi_jobs_completed_total{probe_type=%q} %d\n", progress.probeType, progress.done)
+	fmt.Fprintf(w, "# HELP bidi_jobs_queued Jobs waiting for a free worker.\n")
+	fmt.Fprintf(w, "# TYPE bidi_jobs_queued gauge\n")
+	fmt.Fprintf(w, "bidi_jobs_queued{probe_type=%q} %d\n", progress.probeType, progress.queued)
+	fmt.Fprintf(w, "# HELP bidi_eta_seconds Estimated time until all jobs are complete (-1 if unknown).\n")
+	fmt.Fprintf(w, "# TYPE bidi_eta_seconds gauge\n")
+	fmt.Fprintf(w, "bidi_eta_seconds{probe_type=%q} %f\n", progress.probeType, eta)
+}
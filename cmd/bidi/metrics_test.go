@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	oldStats, oldProgress := stats, scanProgress
+	defer func() { stats, scanProgress = oldStats, oldProgress }()
+
+	stats = &sendStats{}
+	scanProgress = &progress{}
+
+	stats.incPacketPerSec()
+	stats.incBytesPerSec(60)
+	stats.incRetry()
+	stats.incError()
+	stats.incReceived("tls", "tcp_rst")
+	stats.incReceived("tls", "tcp_rst")
+	stats.epochReset(1000)
+
+	scanProgress.begin("tls", 4, func() int { return 2 })
+	scanProgress.incDone()
+
+	addr, err := startMetrics("127.0.0.1:0")
+	require.Nil(t, err)
+
+	resp, err := http.Get("http://" + addr.String() + "/metrics")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain"))
+
+	b, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	body := string(b)
+
+	for _, line := range []string{
+		"# TYPE bidi_sent_packets_total counter",
+		"bidi_sent_packets_total 1",
+		"bidi_sent_bytes_total 60",
+		"bidi_send_packets_per_second 1",
+		"bidi_send_bytes_per_second 60",
+		"bidi_sendto_retries_total 1",
+		"bidi_sendto_errors_total 1",
+		"bidi_capture_dropped_total 0",
+		`bidi_received_packets_total{probe_type="tls",class="tcp_rst"} 2`,
+		`bidi_jobs_total{probe_type="tls"} 4`,
+		`bidi_jobs_completed_total{probe_type="tls"} 1`,
+		`bidi_jobs_queued{probe_type="tls"} 2`,
+	} {
+		require.Contains(t, body, line+"\n")
+	}
+	require.Contains(t, body, `bidi_eta_seconds{probe_type="tls"} `)
+
+	// every sample has a TYPE
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name := strings.FieldsFunc(line, func(r rune) bool { return r == '{' || r == ' ' })[0]
+		require.Contains(t, body, "# TYPE "+name+" ", line)
+	}
+}
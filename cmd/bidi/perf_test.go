@@ -23,7 +23,8 @@ func Benchmark_GeneratePayloads(b *testing.B) {
 /*
 Takeaways:
 - lots (~30%) of TLS payload build time is spent on hex.Decode which is
-  avoidable
+  avoidable (fixed - ClientHellos are now built with cryptobyte, see
+  tls_hello.go)
     - generating payload is really fast anyways and this is a really convenient
       way to interact with things. Might make sense to do this as some sort of
       init if we really care. Or move to using slice init with bytes. But for
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// scanProgress tracks how many of the scan's jobs (domain, ip pairs) have
+// been completed.
+var scanProgress = &progress{}
+
+type progress struct {
+	probeType string
+	total     int64
+	done      int64
+	start     time.Time
+
+	// queued returns the number of jobs waiting for a worker.
+	queued func() int
+
+	mu sync.Mutex
+}
+
+// begin starts tracking a scan of total jobs.
+func (p *progress) begin(probeType string, total int64, queued func() int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.probeType = probeType
+	p.total = total
+	p.done = 0
+	p.start = time.Now()
+	p.queued = queued
+}
+
+func (p *progress) incDone() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+}
+
+// progressSnapshot is the progress of the scan at a point in time.
+type progressSnapshot struct {
+	probeType string
+	done      int64
+	total     int64
+	queued    int
+	elapsed   time.Duration
+	// eta is the estimated time remaining, or -1 if unknown.
+	eta time.Duration
+}
+
+func (p *progress) snapshot() progressSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := progressSnapshot{
+		probeType: p.probeType,
+		done:      p.done,
+		total:     p.total,
+		elapsed:   time.Since(p.start),
+	}
+	if p.queued != nil {
+		s.queued = p.queued()
+	}
+	s.eta = estimateRemaining(s.elapsed, s.done, s.total)
+	return s
+}
+
+// estimateRemaining estimates the time remaining from the average job rate so
+// far. Returns -1 if no jobs have completed.
+func estimateRemaining(elapsed time.Duration, done, total int64) time.Duration {
+	if done <= 0 {
+		return -1
+	} else if done >= total {
+		return 0
+	}
+	return time.Duration(float64(elapsed) * float64(total-done) / float64(done))
+}
+
+// rate returns the average number of jobs completed per second.
+func (s progressSnapshot) rate() float64 {
+	if s.elapsed <= 0 {
+		return 0
+	}
+	return float64(s.done) / s.elapsed.Seconds()
+}
+
+func (s progressSnapshot) String() string {
+	var pct float64
+	if s.total > 0 {
+		pct = float64(s.done) * 100 / float64(s.total)
+	}
+
+	eta := "unknown"
+	if s.eta >= 0 {
+		eta = s.eta.Round(time.Second).String()
+	}
+
+	return fmt.Sprintf("progress %s %.2f%% %d/%d jobs %.1f jobs/s elapsed %s eta %s",
+		s.probeType, pct, s.done, s.total, s.rate(), s.elapsed.Round(time.Second), eta)
+}
+
+// reportProgress writes the scan progress every interval to stderr (rewriting
+// the line in place if stderr is a terminal), to the log, and to the file at
+// progressPath, until exit is closed. A final report is made on exit.
+func reportProgress(interval time.Duration, progressPath string, exit chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	tty := false
+	if fi, err := os.Stderr.Stat(); err == nil {
+		tty = fi.Mode()&os.ModeCharDevice != 0
+	}
+
+	report := func(final bool) {
+		line := scanProgress.snapshot().String()
+		log.Println(line)
+
+		if tty {
+			// return to the start of the line and clear it
+			fmt.Fprintf(os.Stderr, "\r%s\x1b[K", line)
+			if final {
+				fmt.Fprintln(os.Stderr)
+			}
+		} else {
+			fmt.Fprintln(os.Stderr, line)
+		}
+
+		// write then rename so readers never see a partial file
+		tmpPath := progressPath + ".tmp"
+		if err := os.WriteFile(tmpPath, []byte(line+"\n"), 0666); err != nil {
+			log.Printf("failed to write progress file: %v", err)
+			return
+		}
+		if err := os.Rename(tmpPath, progressPath); err != nil {
+			log.Printf("failed to write progress file: %v", err)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			report(false)
+		case <-exit:
+			report(true)
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateRemaining(t *testing.T) {
+	require.Equal(t, time.Duration(-1), estimateRemaining(time.Minute, 0, 10))
+	require.Equal(t, 3*time.Minute, estimateRemaining(time.Minute, 25, 100))
+	require.Equal(t, time.Duration(0), estimateRemaining(time.Minute, 100, 100))
+}
+
+func TestProgressString(t *testing.T) {
+	s := progressSnapshot{
+		probeType: "tls",
+		done:      25,
+		total:     100,
+		elapsed:   50 * time.Second,
+		eta:       150 * time.Second,
+	}
+	require.Equal(t, "progress tls 25.00% 25/100 jobs 0.5 jobs/s elapsed 50s eta 2m30s", s.String())
+
+	s = progressSnapshot{probeType: "dns", total: 10, eta: -1}
+	require.Equal(t, "progress dns 0.00% 0/10 jobs 0.0 jobs/s elapsed 0s eta unknown", s.String())
+}
+
+func TestReportProgress(t *testing.T) {
+	oldProgress := scanProgress
+	defer func() { scanProgress = oldProgress }()
+	scanProgress = &progress{}
+	scanProgress.begin("tls", 2, nil)
+	scanProgress.incDone()
+
+	progressPath := filepath.Join(t.TempDir(), "progress.txt")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	exit := make(chan struct{})
+	go reportProgress(time.Hour, progressPath, exit, &wg)
+	close(exit)
+	wg.Wait()
+
+	b, err := os.ReadFile(progressPath)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(string(b), "progress tls 50.00% 1/2 jobs"), string(b))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	maxLabelLen = 63
+	// maximum length of a name in wire format including the root label
+	maxNameLen = 255
+
+	qnameAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+// qnameOptions configures how the tested domain is permuted into the qname
+// sent in DNS queries, to test whether injectors match exact names, suffixes,
+// or case-insensitively.
+type qnameOptions struct {
+	// randomCase applies 0x20 random capitalization to each letter
+	randomCase bool
+
+	// trailingDot appends a literal (escaped) dot to the last label, e.g.
+	// "example.com\." so the name differs from the domain only by a trailing
+	// dot that is part of the name rather than the root label.
+	trailingDot bool
+
+	// prefixLen prepends a random label of this length, e.g.
+	// "x7q2k.example.com". 0 disables the prefix.
+	prefixLen int
+
+	// pad prepends random labels of the maximum length until the name is
+	// the maximum length.
+	pad bool
+}
+
+// qname returns the fully qualified name (in presentation format) to query
+// for name.
+func (o qnameOptions) qname(name string) string {
+	qname := strings.TrimSuffix(name, ".")
+
+	if o.prefixLen > 0 {
+		qname = randomLabel(o.prefixLen) + "." + qname
+	}
+
+	if o.pad {
+		// wire length is the presentation length plus the first length byte
+		// and the root label, and the escaped trailing dot adds one byte.
+		reserved := 2
+		if o.trailingDot {
+			reserved++
+		}
+		for {
+			room := maxNameLen - reserved - len(qname) - 1
+			if room < 1 {
+				break
+			} else if room > maxLabelLen {
+				room = maxLabelLen
+			}
+			qname = randomLabel(room) + "." + qname
+		}
+	}
+
+	if o.trailingDot {
+		qname += `\.`
+	}
+
+	if o.randomCase {
+		qname = randomCase(qname)
+	}
+
+	return dns.Fqdn(qname)
+}
+
+// randomLabel returns a random label of n lowercase letters and digits.
+func randomLabel(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = qnameAlphabet[rand.Intn(len(qnameAlphabet))]
+	}
+	return string(b)
+}
+
+// randomCase randomly capitalizes each ASCII letter of name (DNS 0x20
+// encoding).
+func randomCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') && rand.Intn(2) == 1 {
+			b[i] = c ^ 0x20
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQNamePermutation(t *testing.T) {
+	require.Equal(t, "example.com.", qnameOptions{}.qname("example.com"))
+
+	o := qnameOptions{randomCase: true}
+	qname := o.qname("abcdefghijklmnopqrstuvwxyz.com")
+	require.True(t, strings.EqualFold("abcdefghijklmnopqrstuvwxyz.com.", qname))
+	require.NotEqual(t, "abcdefghijklmnopqrstuvwxyz.com.", qname)
+
+	o = qnameOptions{trailingDot: true}
+	qname = o.qname("example.com.")
+	require.Equal(t, `example.com\..`, qname)
+	require.Equal(t, "\x07example\x04com.", dnsWireName(qname))
+
+	o = qnameOptions{prefixLen: 8}
+	qname = o.qname("example.com")
+	require.Equal(t, 21, len(qname))
+	require.True(t, strings.HasSuffix(qname, ".example.com."))
+
+	for _, trailingDot := range []bool{false, true} {
+		o = qnameOptions{pad: true, trailingDot: trailingDot, randomCase: true}
+		qname = o.qname("example.com")
+
+		buf := make([]byte, 512)
+		n, err := dns.PackDomainName(qname, buf, 0, nil, false)
+		require.Nil(t, err)
+		require.Equal(t, maxNameLen, n)
+		require.Equal(t, maxLabelLen, len(dns.SplitDomainName(qname)[1]))
+	}
+}
+
+func TestQNameQuery(t *testing.T) {
+	p := &dnsProber{qname: qnameOptions{randomCase: true, prefixLen: 4}}
+	qname := p.qname.qname("example.com")
+
+	out, err := p.buildQuery(qname, dns.TypeA)
+	require.Nil(t, err)
+
+	// the exact casing is sent
+	m := new(dns.Msg)
+	require.Nil(t, m.Unpack(out))
+	require.Equal(t, qname, m.Question[0].Name)
+}
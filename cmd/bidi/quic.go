@@ -43,9 +43,9 @@ func (p *quicProber) sendProbe(ip net.IP, name string, verbose bool) error {
 	}
 
 	addr := net.JoinHostPort(ip.String(), "443")
-	sport, err = p.sender.sendUDP(addr, sport.(int), out, verbose)
+	laddr, err := p.sender.sendUDP(addr, sport.(int), out, verbose)
 	if err == nil && verbose {
-		log.Printf("Sent :%s -> %s %s %s\n", sport, addr, name, clientID)
+		log.Printf("Sent %s -> %s %s %s\n", laddr, addr, name, clientID)
 	}
 
 	return err
@@ -78,17 +78,18 @@ func (p *quicProber) buildPayload(name string, target net.IP, sport int) ([]byte
 
 	token := "00"
 
-	// dynamic - packet length
-	packetLen := "4" + fmt.Sprintf("%03x", 0xfa+len(name))
-
-	var packetNum uint64 = 0
-	packetNumStr := fmt.Sprintf("%02x", packetNum)
-
 	paylaod, err := p.buildCryptoFramePaylaod(name)
 	if err != nil {
 		return nil, "", err
 	}
 
+	// dynamic - packet length (2 byte varint) of the packet number, payload,
+	// and AEAD tag
+	packetLen := fmt.Sprintf("%04x", 0x4000|(1+len(paylaod)+16))
+
+	var packetNum uint64 = 0
+	packetNumStr := fmt.Sprintf("%02x", packetNum)
+
 	header := headerByteAndVersion + dstConnID + srcConnID + token + packetLen + packetNumStr
 	headerData, err := hex.DecodeString(header)
 	if err != nil {
@@ -126,51 +127,36 @@ func (p *quicProber) buildPayload(name string, target net.IP, sport int) ([]byte
 	return out, hex.EncodeToString(clientID), err
 }
 
-func (p *quicProber) buildCryptoFramePaylaod(name string) ([]byte, error) {
-
-	// var fulldata = "060040ee010000f40303000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20e0e1e2e3e4e5e6e7e8e9eaebecedeeeff0f1f2f3f4f5f6f7f8f9fafbfcfdfeff000813021303130100ff010000a30000001800160000136578616d706c652e756c666865696d2e6e6574000b000403000102000a00160014001d0017001e0019001801000101010201030104002300000016000000170000000d001e001c040305030603080708080809080a080b080408050806040105010601002b0003020304002d00020101003300260024001d0020358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254"
-
-	//
-	var ch = "06004" + fmt.Sprintf("%03x", len(name)+0xe5)
-
-	// dynamic - Handshake header and client version
-	var hh = "01" + fmt.Sprintf("%06x", len(name)+0xe1) + "0303"
+// quicKeyShare is the X25519 public key sent in every QUIC ClientHello.
+var quicKeyShare, _ = hex.DecodeString("358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254")
 
-	// dynamic - client Rand (32 generated bytes)
-	buf := make([]byte, 32)
-	n, err := rand.Read(buf)
-	if err != nil || n != 32 {
-		return nil, fmt.Errorf("failed rand read: %s", err)
+func (p *quicProber) buildCryptoFramePaylaod(name string) ([]byte, error) {
+	random, err := randomBytes(32)
+	if err != nil {
+		return nil, err
 	}
-	var clientRandom = hex.EncodeToString(buf)
-
-	// dynamic - session ID (33 bytes 32 generated)
-	n, err = rand.Read(buf)
-	if err != nil || n != 32 {
-		return nil, fmt.Errorf("failed rand read: %s", err)
+	sessionID, err := randomBytes(32)
+	if err != nil {
+		return nil, err
 	}
-	var sessionID = "20" + hex.EncodeToString(buf)
-
-	// Ciphersuites & Compression methods
-	var csAndCM = "000813021303130100ff0100"
-
-	// dynamic - Extensions lenggth (00a3)
-	var extensionsLen = fmt.Sprintf("%04x", len(name)+0x90)
 
-	var extSNIID = "0000"
-	// dynamic - Extension lenggth (0018)
-	var extSNIDataLen = fmt.Sprintf("%04x", len(name)+5)
-	// dynamic - Extension lenggth (0016)
-	var extSNIEntryLen = fmt.Sprintf("%04x", len(name)+3)
-	var extSNIEntryType = "00"
-	// dynamic - Extension lenggth (0013)
-	var hostnameLen = fmt.Sprintf("%04x", len(name))
-	var hostname = hex.EncodeToString([]byte(name))
+	// the key share is sent last
+	h := tls13Hello(name, random, sessionID, quicKeyShare)
+	h.removeExtension(extKeyShare)
+	h.setExtension(keyShareExtension(keyShare{groupX25519, quicKeyShare}))
 
-	var otherExtensions = "000b000403000102000a00160014001d0017001e0019001801000101010201030104002300000016000000170000000d001e001c040305030603080708080809080a080b080408050806040105010601002b0003020304002d00020101003300260024001d0020358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254"
-	fulldata := ch + hh + clientRandom + sessionID + csAndCM + extensionsLen + extSNIID + extSNIDataLen + extSNIEntryLen + extSNIEntryType + hostnameLen + hostname + otherExtensions
+	hello, err := h.marshalHandshake()
+	if err != nil {
+		return nil, err
+	}
 
-	return hex.DecodeString(fulldata)
+	// CRYPTO frame at offset 0 with a 2 byte varint length
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(0x06)
+	b.AddUint8(0x00)
+	b.AddUint16(0x4000 | uint16(len(hello)))
+	b.AddBytes(hello)
+	return b.Bytes()
 }
 
 func (p *quicProber) handlePcap(iface string, exit chan struct{}, wg *sync.WaitGroup) {
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// sentPcap records every packet sent through sendPkt. nil disables recording.
+var sentPcap *pcapRecorder
+
+// pcapRecorder writes serialized outgoing packets (starting at the IP header)
+// to a gzipped pcap so that probes can be correlated byte for byte with the
+// captured responses.
+type pcapRecorder struct {
+	w        *rotatingPcapWriter
+	nPackets int64
+
+	mu sync.Mutex
+}
+
+func newPcapRecorder(pcapPath string) (*pcapRecorder, error) {
+	// packets are written from the IP header so use the raw link type
+	w, err := newRotatingPcapWriter(pcapPath, 65535, layers.LinkTypeRaw, pcapRotation)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pcapRecorder{w: w}, nil
+}
+
+// record writes a sent packet to the pcap.
+func (r *pcapRecorder) record(pkt []byte) {
+	if r == nil {
+		return
+	}
+
+	ci := gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(pkt),
+		Length:        len(pkt),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		// packets sent after close (e.g. delayed RSTs) are not recorded
+		return
+	}
+	if err := r.w.WritePacket(ci, pkt); err != nil {
+		log.Printf("sent pcap WritePacket() error: %v", err)
+		return
+	}
+	r.nPackets++
+}
+
+// close flushes and closes the pcap.
+func (r *pcapRecorder) close() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Close(); err != nil {
+		log.Printf("sent pcap Close() error: %v", err)
+	}
+	r.w = nil
+	log.Printf("Closing sent pcap - recorded %d packets", r.nPackets)
+}
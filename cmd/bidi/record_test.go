@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPcapRecorder(t *testing.T) {
+	pcapPath := filepath.Join(t.TempDir(), "sent.pcap")
+	r, err := newPcapRecorder(pcapPath)
+	require.Nil(t, err)
+
+	pkt := testUDPPacket(t, &layers.IPv4{
+		SrcIP:    []byte{192, 168, 0, 1},
+		DstIP:    []byte{192, 168, 0, 2},
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+	}, []byte("abcdefgh"))
+	r.record(pkt)
+	r.close()
+
+	// packets recorded after close are dropped
+	r.record(pkt)
+
+	f, err := os.Open(pcapPath + ".gz")
+	require.Nil(t, err)
+	defer f.Close()
+
+	reader, err := pcapgo.NewReader(f)
+	require.Nil(t, err)
+	require.Equal(t, layers.LinkTypeRaw, reader.LinkType())
+
+	var packets []gopacket.Packet
+	for packet := range gopacket.NewPacketSource(reader, reader.LinkType()).Packets() {
+		packets = append(packets, packet)
+	}
+	require.Equal(t, 1, len(packets))
+	require.Equal(t, pkt, packets[0].Data())
+	require.NotNil(t, packets[0].Layer(layers.LayerTypeUDP))
+
+	// recording is disabled by default
+	var disabled *pcapRecorder
+	disabled.record(pkt)
+	disabled.close()
+}
+
+func TestRotatingPcapWriter(t *testing.T) {
+	dir := t.TempDir()
+	pcapPath := filepath.Join(dir, "tls.pcap")
+
+	w, err := newRotatingPcapWriter(pcapPath, 1600, layers.LinkTypeRaw, rotation{maxAge: time.Nanosecond})
+	require.Nil(t, err)
+
+	pkt := []byte{0x45, 0, 0, 20}
+	for i := 0; i < 3; i++ {
+		require.Nil(t, w.WritePacket(gopacket.CaptureInfo{CaptureLength: 4, Length: 4}, pkt))
+	}
+	require.Nil(t, w.Close())
+
+	b, err := os.ReadFile(filepath.Join(dir, "tls.index.json"))
+	require.Nil(t, err)
+	var index pcapIndex
+	require.Nil(t, json.Unmarshal(b, &index))
+	require.Equal(t, layers.LinkTypeRaw, index.LinkType)
+	require.Equal(t, 3, len(index.Segments))
+
+	for i, segment := range index.Segments {
+		require.Equal(t, fmt.Sprintf("tls.%06d.pcap.gz", i), segment.File)
+		require.Equal(t, int64(1), segment.Packets)
+		require.False(t, segment.End.Before(segment.Start))
+
+		f, err := os.Open(filepath.Join(dir, segment.File))
+		require.Nil(t, err)
+		reader, err := pcapgo.NewReader(f)
+		require.Nil(t, err)
+		data, _, err := reader.ReadPacketData()
+		require.Nil(t, err)
+		require.Equal(t, pkt, data)
+		f.Close()
+	}
+
+	// without rotation a single file is written and there is no index
+	pcapPath = filepath.Join(dir, "dns.pcap")
+	w, err = newRotatingPcapWriter(pcapPath, 1600, layers.LinkTypeRaw, rotation{})
+	require.Nil(t, err)
+	require.Nil(t, w.WritePacket(gopacket.CaptureInfo{CaptureLength: 4, Length: 4}, pkt))
+	require.Nil(t, w.Close())
+	_, err = os.Stat(pcapPath + ".gz")
+	require.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "dns.index.json"))
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// probeRepeat configures sending each probe more than once so that responses
+// can be counted per probe, distinguishing targets that never respond from
+// probes or responses that were lost, and triggering censors that only react
+// to retransmissions.
+//
+// In identical mode the senders retransmit the exact same packets (same
+// sequence numbers, ports, and payload). In fresh mode the worker sends a new
+// probe each time (new sequence numbers and random fields) with the same
+// source port.
+type probeRepeat struct {
+	count    int
+	interval time.Duration
+	fresh    bool
+}
+
+// newProbeRepeat returns nil if count is less than 2, disabling repeats.
+func newProbeRepeat(count int, interval time.Duration, mode string) (*probeRepeat, error) {
+	r := &probeRepeat{count: count, interval: interval}
+	switch mode {
+	case "identical":
+	case "fresh":
+		r.fresh = true
+	default:
+		return nil, fmt.Errorf("unknown repeat mode \"%s\" - must be identical or fresh", mode)
+	}
+
+	if count < 2 {
+		return nil, nil
+	} else if interval < 0 {
+		return nil, fmt.Errorf("repeat interval must not be negative")
+	}
+	return r, nil
+}
+
+// identical returns the number of times senders should retransmit each probe.
+func (r *probeRepeat) identical() int {
+	if r == nil || r.fresh {
+		return 0
+	}
+	return r.count - 1
+}
+
+// probes returns the number of probes the worker should send for each job.
+func (r *probeRepeat) probes() int {
+	if r == nil || !r.fresh {
+		return 1
+	}
+	return r.count
+}
+
+func (r *probeRepeat) String() string {
+	if r == nil {
+		return "none"
+	}
+	mode := "identical"
+	if r.fresh {
+		mode = "fresh"
+	}
+	return fmt.Sprintf("%dx%s %s", r.count, r.interval, mode)
+}
+
+// retransmit calls send n times, waiting interval before each call.
+func retransmit(n int, interval time.Duration, send func() error) error {
+	for i := 0; i < n; i++ {
+		time.Sleep(interval)
+		if err := send(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeRepeat(t *testing.T) {
+	r, err := newProbeRepeat(1, time.Second, "identical")
+	require.Nil(t, err)
+	require.Nil(t, r)
+	require.Equal(t, 0, r.identical())
+	require.Equal(t, 1, r.probes())
+
+	r, err = newProbeRepeat(3, time.Second, "identical")
+	require.Nil(t, err)
+	require.Equal(t, 2, r.identical())
+	require.Equal(t, 1, r.probes())
+	require.Equal(t, "3x1s identical", r.String())
+
+	r, err = newProbeRepeat(3, time.Second, "fresh")
+	require.Nil(t, err)
+	require.Equal(t, 0, r.identical())
+	require.Equal(t, 3, r.probes())
+
+	_, err = newProbeRepeat(3, time.Second, "bogus")
+	require.NotNil(t, err)
+	_, err = newProbeRepeat(3, -time.Second, "fresh")
+	require.NotNil(t, err)
+
+	var sent int
+	err = retransmit(3, 0, func() error { sent++; return nil })
+	require.Nil(t, err)
+	require.Equal(t, 3, sent)
+}
+
+// countingProber counts probes sent with and without residual control probes.
+type countingProber struct {
+	probes   int
+	triggers int
+}
+
+func (p *countingProber) registerFlags() {}
+
+func (p *countingProber) sendProbe(ip net.IP, name string, verbose bool) error {
+	p.probes++
+	return nil
+}
+
+func (p *countingProber) sendTrigger(ip net.IP, name string, verbose bool) (string, string, error) {
+	p.triggers++
+	return "", "", nil
+}
+
+func (p *countingProber) handlePcap(iface string, exit chan struct{}, wg *sync.WaitGroup) {}
+
+func TestFreshRepeatResidual(t *testing.T) {
+	r, err := newProbeRepeat(3, 0, "fresh")
+	require.Nil(t, err)
+
+	p := &countingProber{}
+	jobs := make(chan *job, 2)
+	jobs <- &job{domain: "example.com", ip: "192.0.2.1"}
+	jobs <- &job{domain: "example.org", ip: "192.0.2.1"}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	worker(p, 0, r, false, jobs, &wg)
+
+	// residual control probes are scheduled once per job, after the last
+	// repeat
+	require.Equal(t, 2, p.probes)
+	require.Equal(t, 4, p.triggers)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// residualScheduler sends control probes after a trigger probe in order to
+// measure residual censorship, where a censor continues to block the
+// (source ip, destination ip, destination port) 3-tuple for some time after a
+// probe containing a blocked domain was observed.
+//
+// Control probes carry a benign domain and are sent to the same target, from
+// the same source address and port as the trigger (so the KeyTable maps
+// responses to the trigger domain), each at the configured delay after the
+// trigger. Whether the control probes draw injected responses can be checked
+// against the "Residual" lines in the log.
+//
+// Rather than a timer per control probe, which would hold millions of live
+// timers over a large scan, triggers are kept in a FIFO queue per delay. As
+// every trigger waits the same delays, each queue is in the order its control
+// probes are due, and a single goroutine sends the earliest due probe from the
+// heads of the queues.
+type residualScheduler struct {
+	delays  []time.Duration
+	control string
+
+	// queues holds the triggers awaiting the control probe of each delay.
+	queues [][]*residualTrigger
+	mu     sync.Mutex
+	// wake interrupts the scheduler when a queue was empty and may now hold
+	// the earliest due probe.
+	wake chan struct{}
+
+	// wg counts the control probes not yet sent.
+	wg sync.WaitGroup
+}
+
+// residualTrigger is a trigger probe awaiting its control probes.
+type residualTrigger struct {
+	sent time.Time
+	// send sends a control probe and returns the sequence numbers used.
+	send func() (string, error)
+	// desc describes the probes in the log, "<laddr> -> <dst> <trigger>
+	// <control>".
+	desc string
+}
+
+// newResidualScheduler parses a comma separated list of delays (e.g.
+// "10s,60s,120s"). Returns nil if no delays are given, disabling residual
+// measurement.
+func newResidualScheduler(spec, control string) (*residualScheduler, error) {
+	if spec == "" || spec == "none" {
+		return nil, nil
+	}
+
+	r := &residualScheduler{control: control}
+	for _, d := range strings.Split(spec, ",") {
+		delay, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil {
+			return nil, fmt.Errorf("bad residual delay \"%s\": %s", d, err)
+		} else if delay <= 0 {
+			return nil, fmt.Errorf("residual delays must be positive")
+		}
+		r.delays = append(r.delays, delay)
+	}
+
+	if control == "" {
+		return nil, fmt.Errorf("residual measurement requires a control domain")
+	}
+
+	r.queues = make([][]*residualTrigger, len(r.delays))
+	r.wake = make(chan struct{}, 1)
+	go r.run()
+
+	return r, nil
+}
+
+// schedule queues control probes following a trigger probe sent from laddr
+// (ip:port) to dst (ip:port). build creates the probe payload for the control
+// domain.
+func (r *residualScheduler) schedule(t *tcpSender, laddr, dst, trigger string, build func(string) ([]byte, error), verbose bool) error {
+	if r == nil {
+		return nil
+	}
+
+	srcHost, sportStr, err := net.SplitHostPort(laddr)
+	if err != nil {
+		return fmt.Errorf("failed to parse \"ip:port\": %s - %s", laddr, err)
+	}
+	sport, _ := strconv.Atoi(sportStr)
+
+	host, portStr, err := net.SplitHostPort(dst)
+	if err != nil {
+		return fmt.Errorf("failed to parse \"ip:port\": %s - %s", dst, err)
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	src := net.ParseIP(srcHost)
+	ip := net.ParseIP(host)
+	if ip.To4() != nil {
+		src = src.To4()
+	}
+
+	desc := fmt.Sprintf("%s -> %s %s %s", laddr, dst, trigger, r.control)
+	r.enqueue(desc, func() (string, error) {
+		payload, err := build(r.control)
+		if err != nil {
+			return "", err
+		}
+		seqAck, _, err := t.sendTCPFrom(src, ip, port, sport, r.control, payload, verbose)
+		return seqAck, err
+	})
+
+	return nil
+}
+
+// enqueue queues the control probes of a trigger sent now. send sends a
+// control probe, returning the sequence numbers used. desc describes the
+// probe in the log.
+func (r *residualScheduler) enqueue(desc string, send func() (string, error)) {
+	tr := &residualTrigger{desc: desc, send: send}
+
+	r.mu.Lock()
+	tr.sent = time.Now()
+	wake := false
+	for i := range r.queues {
+		wake = wake || len(r.queues[i]) == 0
+		r.queues[i] = append(r.queues[i], tr)
+	}
+	r.wg.Add(len(r.queues))
+	r.mu.Unlock()
+
+	if wake {
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// next returns the earliest due control probe, as the index of its delay, and
+// when it is due. i is -1 if no probes are queued.
+func (r *residualScheduler) next() (i int, due time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i = -1
+	for j, q := range r.queues {
+		if len(q) == 0 {
+			continue
+		}
+		if d := q[0].sent.Add(r.delays[j]); i < 0 || d.Before(due) {
+			i, due = j, d
+		}
+	}
+	return i, due
+}
+
+// run sends each control probe when it is due.
+func (r *residualScheduler) run() {
+	for {
+		i, due := r.next()
+		if i < 0 {
+			<-r.wake
+			continue
+		}
+		if d := time.Until(due); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case <-r.wake:
+				timer.Stop()
+				continue
+			}
+		}
+
+		// only run pops from the queues so the head is still the probe due
+		r.mu.Lock()
+		tr := r.queues[i][0]
+		r.queues[i][0] = nil
+		r.queues[i] = r.queues[i][1:]
+		r.mu.Unlock()
+
+		// sends (e.g. stateful handshakes) can block, so they do not hold up
+		// the probes due after them
+		go r.send(tr, i)
+	}
+}
+
+func (r *residualScheduler) send(tr *residualTrigger, i int) {
+	defer r.wg.Done()
+
+	seqAck, err := tr.send()
+	if err != nil {
+		log.Printf("Residual %s %d %s - error: %v\n", tr.desc, i, r.delays[i], err)
+		return
+	}
+	log.Printf("Residual %s %d %s %s\n", tr.desc, i, r.delays[i], seqAck)
+}
+
+// wait blocks until all scheduled control probes have been sent.
+func (r *residualScheduler) wait() {
+	if r == nil {
+		return
+	}
+	r.wg.Wait()
+}
+
+func (r *residualScheduler) String() string {
+	if r == nil {
+		return "none"
+	}
+	var s []string
+	for _, d := range r.delays {
+		s = append(s, d.String())
+	}
+	return fmt.Sprintf("%s after %s", r.control, strings.Join(s, ","))
+}
+
+// sendResidual schedules residual control probes following a trigger probe if
+// residual measurement is enabled. See residualScheduler.
+func (t *tcpSender) sendResidual(laddr, dst, trigger string, build func(string) ([]byte, error), verbose bool) error {
+	return t.residual.schedule(t, laddr, dst, trigger, build, verbose)
+}
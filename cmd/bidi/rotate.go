@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapRotation configures splitting the pcaps written by capturePcap (and
+// the sent packet pcap) into segments. The zero value disables rotation.
+var pcapRotation rotation
+
+type rotation struct {
+	// maxBytes rotates once the compressed segment reaches this size. 0
+	// disables size based rotation.
+	maxBytes int64
+	// maxAge rotates once a segment has been open this long. 0 disables time
+	// based rotation.
+	maxAge time.Duration
+}
+
+func (r rotation) enabled() bool {
+	return r.maxBytes > 0 || r.maxAge > 0
+}
+
+func (r rotation) String() string {
+	if !r.enabled() {
+		return "none"
+	}
+	return fmt.Sprintf("%dMB %s", r.maxBytes>>20, r.maxAge)
+}
+
+// pcapSegment describes a single pcap file in a pcapIndex.
+type pcapSegment struct {
+	File    string    `json:"file"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Packets int64     `json:"packets"`
+}
+
+// pcapIndex lists the segments of a rotated pcap in order. It is written
+// alongside the segments as <name>.index.json and rewritten each time a
+// segment is closed so that completed segments can be processed while the
+// scan is still running, or recovered if the scan dies.
+type pcapIndex struct {
+	LinkType layers.LinkType `json:"link_type"`
+	Segments []pcapSegment   `json:"segments"`
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// rotatingPcapWriter writes a gzipped pcap, splitting it into sequentially
+// numbered segments (e.g. tls.000000.pcap.gz, tls.000001.pcap.gz, ...) when
+// rotation is enabled. Without rotation a single <name>.pcap.gz is written and
+// no index is created.
+type rotatingPcapWriter struct {
+	pcapPath string
+	snaplen  uint32
+	linkType layers.LinkType
+	rotation rotation
+
+	f         *os.File
+	counter   *countingWriter
+	outWriter *bufio.Writer
+	archiver  *gzip.Writer
+	w         *pcapgo.Writer
+	segment   pcapSegment
+
+	index pcapIndex
+}
+
+func newRotatingPcapWriter(pcapPath string, snaplen uint32, linkType layers.LinkType, r rotation) (*rotatingPcapWriter, error) {
+	w := &rotatingPcapWriter{
+		pcapPath: pcapPath,
+		snaplen:  snaplen,
+		linkType: linkType,
+		rotation: r,
+		index:    pcapIndex{LinkType: linkType},
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// segmentPath returns the file name of the nth segment.
+func (w *rotatingPcapWriter) segmentPath(n int) string {
+	if !w.rotation.enabled() {
+		return w.pcapPath + ".gz"
+	}
+	base := strings.TrimSuffix(w.pcapPath, ".pcap")
+	return fmt.Sprintf("%s.%06d.pcap.gz", base, n)
+}
+
+func (w *rotatingPcapWriter) indexPath() string {
+	return strings.TrimSuffix(w.pcapPath, ".pcap") + ".index.json"
+}
+
+func (w *rotatingPcapWriter) open() error {
+	segmentPath := w.segmentPath(len(w.index.Segments))
+
+	f, err := os.Create(segmentPath)
+	if err != nil {
+		return err
+	}
+
+	w.counter = &countingWriter{w: f}
+	// Required otherwise io doesn't flush properly on close
+	w.outWriter = bufio.NewWriter(w.counter)
+
+	// Write PCAP in compressed format.
+	w.archiver = gzip.NewWriter(w.outWriter)
+	w.archiver.Name = strings.TrimSuffix(filepath.Base(segmentPath), ".gz")
+
+	w.w = pcapgo.NewWriter(w.archiver)
+	if err := w.w.WriteFileHeader(w.snaplen, w.linkType); err != nil {
+		f.Close()
+		return err
+	}
+
+	w.f = f
+	w.segment = pcapSegment{File: filepath.Base(segmentPath), Start: time.Now()}
+	return nil
+}
+
+// closeSegment closes the current segment and records it in the index.
+func (w *rotatingPcapWriter) closeSegment() error {
+	w.archiver.Close()
+	w.outWriter.Flush()
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+
+	w.segment.End = time.Now()
+	w.index.Segments = append(w.index.Segments, w.segment)
+	if !w.rotation.enabled() {
+		return nil
+	}
+	return w.writeIndex()
+}
+
+func (w *rotatingPcapWriter) writeIndex() error {
+	b, err := json.MarshalIndent(w.index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write then rename so readers never see a partial index
+	tmpPath := w.indexPath() + ".tmp"
+	if err := os.WriteFile(tmpPath, b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, w.indexPath())
+}
+
+// WritePacket writes a packet to the current segment, rotating first if the
+// segment is full.
+func (w *rotatingPcapWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	if w.full() {
+		if err := w.closeSegment(); err != nil {
+			return err
+		}
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.w.WritePacket(ci, data); err != nil {
+		return err
+	}
+	w.segment.Packets++
+	return nil
+}
+
+func (w *rotatingPcapWriter) full() bool {
+	if w.segment.Packets == 0 {
+		return false
+	}
+	if w.rotation.maxBytes > 0 && w.counter.n >= w.rotation.maxBytes {
+		return true
+	}
+	if w.rotation.maxAge > 0 && time.Since(w.segment.Start) >= w.rotation.maxAge {
+		return true
+	}
+	return false
+}
+
+// Close closes the final segment and writes the final index.
+func (w *rotatingPcapWriter) Close() error {
+	return w.closeSegment()
+}
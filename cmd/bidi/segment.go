@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// tcpSegment is one piece of a tcp probe payload. Offset is relative to the
+// first byte of the payload so the sequence number of the segment is the
+// sequence number of the first data byte plus the offset.
+type tcpSegment struct {
+	offset int
+	data   []byte
+}
+
+// tcpSegmenter splits the payload of tcp probes into multiple segments in
+// order to test whether middle-boxes reassemble the stream before matching.
+//
+// Supported modes are:
+//
+//	none      - send the payload in one segment
+//	offset:N  - split the payload at byte offset N
+//	domain    - split the payload in the middle of the first occurrence of
+//	            the probed domain (i.e. inside the Host header or the SNI)
+//	equal:N   - split the payload into N (roughly) equal segments
+//	records   - split the payload at TLS record boundaries so that each
+//	            record is sent in its own segment (see -tls-records)
+//
+// If reverse is set segments are sent last to first. If overlap is non-zero
+// each segment is extended by that many bytes into the following segment and
+// the overlapping bytes are filled with junk, so that the overlapping region is
+// sent twice with different content - first the junk, then the real bytes.
+type tcpSegmenter struct {
+	mode    string
+	offset  int
+	n       int
+	reverse bool
+	overlap int
+}
+
+func parseSegmenter(spec, order string, overlap int) (*tcpSegmenter, error) {
+	s := &tcpSegmenter{overlap: overlap}
+
+	switch order {
+	case "", "forward":
+	case "reverse":
+		s.reverse = true
+	default:
+		return nil, fmt.Errorf("unknown segment order \"%s\" - must be forward or reverse", order)
+	}
+
+	if overlap < 0 {
+		return nil, fmt.Errorf("segment overlap must not be negative")
+	}
+
+	mode, arg, hasArg := strings.Cut(spec, ":")
+	switch mode {
+	case "", "none", "domain", "records":
+	case "offset", "equal":
+		if !hasArg {
+			return nil, fmt.Errorf("segment mode \"%s\" requires a value (e.g. \"%s:4\")", mode, mode)
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("bad segment value \"%s\"", arg)
+		}
+		if mode == "offset" {
+			s.offset = n
+		} else {
+			s.n = n
+		}
+	default:
+		return nil, fmt.Errorf("unknown segment mode \"%s\"", mode)
+	}
+	s.mode = mode
+
+	return s, nil
+}
+
+// split returns the segments for the payload in the order they should be
+// sent.
+func (s *tcpSegmenter) split(payload []byte, domain string) []tcpSegment {
+	if len(payload) == 0 {
+		return []tcpSegment{{offset: 0, data: payload}}
+	}
+
+	var segments []tcpSegment
+	start := 0
+	for _, c := range append(s.cuts(payload, domain), len(payload)) {
+		if c <= start || c > len(payload) {
+			continue
+		}
+		segments = append(segments, tcpSegment{offset: start, data: payload[start:c]})
+		start = c
+	}
+	if start < len(payload) {
+		segments = append(segments, tcpSegment{offset: start, data: payload[start:]})
+	}
+
+	if s.overlap > 0 {
+		for i := 0; i < len(segments)-1; i++ {
+			n := s.overlap
+			if next := len(segments[i+1].data); n > next {
+				n = next
+			}
+			junk := make([]byte, n)
+			for j := range junk {
+				junk[j] = byte('a' + rand.Intn(26))
+			}
+			data := make([]byte, 0, len(segments[i].data)+n)
+			data = append(data, segments[i].data...)
+			segments[i].data = append(data, junk...)
+		}
+	}
+
+	if s.reverse {
+		for i, j := 0, len(segments)-1; i < j; i, j = i+1, j-1 {
+			segments[i], segments[j] = segments[j], segments[i]
+		}
+	}
+
+	return segments
+}
+
+// cuts returns the offsets in payload at which it is split.
+func (s *tcpSegmenter) cuts(payload []byte, domain string) []int {
+	var cuts []int
+	switch s.mode {
+	case "offset":
+		cuts = []int{s.offset}
+	case "domain":
+		if i := bytes.Index(payload, []byte(domain)); i >= 0 && domain != "" {
+			cuts = []int{i + len(domain)/2}
+		}
+	case "equal":
+		size := (len(payload) + s.n - 1) / s.n
+		for c := size; c < len(payload) && size > 0; c += size {
+			cuts = append(cuts, c)
+		}
+	case "records":
+		for c := 0; c+5 <= len(payload); {
+			c += 5 + int(binary.BigEndian.Uint16(payload[c+3:]))
+			if c < len(payload) {
+				cuts = append(cuts, c)
+			}
+		}
+	}
+	return cuts
+}
@@ -1,21 +1,19 @@
 package main
 
 import (
-	"bufio"
-	"compress/gzip"
 	"encoding/hex"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
-	"os"
-	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
-	"github.com/google/gopacket/pcapgo"
 	"github.com/google/gopacket/routing"
 )
 
@@ -30,10 +28,72 @@ type sendStats struct {
 	pt int64
 	// bytes total
 	bt int64
+	// sendto retries total
+	rt int64
+	// sendto errors (failures after all retries) total
+	et int64
+	// packets received (captured) total by probe type and result class
+	rcv map[string]map[string]int64
+
+	// send rates over the last epoch
+	pps float64
+	bps float64
 
 	mu sync.Mutex
 }
 
+func (s *sendStats) incRetry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rt++
+}
+
+func (s *sendStats) incError() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.et++
+}
+
+// incReceived counts a captured packet for the probe type name, classified
+// by classifyPacket.
+func (s *sendStats) incReceived(name, class string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rcv == nil {
+		s.rcv = make(map[string]map[string]int64)
+	}
+	if s.rcv[name] == nil {
+		s.rcv[name] = make(map[string]int64)
+	}
+	s.rcv[name][class]++
+}
+
+// received formats the received packet counts by probe type (e.g.
+// "tls:1234"), or "-" if nothing has been received.
+func (s *sendStats) received() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.rcv) == 0 {
+		return "-"
+	}
+
+	names := make([]string, 0, len(s.rcv))
+	for name := range s.rcv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	counts := make([]string, 0, len(names))
+	for _, name := range names {
+		var n int64
+		for _, c := range s.rcv[name] {
+			n += c
+		}
+		counts = append(counts, fmt.Sprintf("%s:%d", name, n))
+	}
+	return strings.Join(counts, ",")
+}
+
 func (s *sendStats) incPacketPerSec() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -48,17 +108,30 @@ func (s *sendStats) incBytesPerSec(n int) {
 	s.bt += int64(n)
 }
 
-func (s *sendStats) epochReset() {
+// epochReset records the send rates for an epoch of length epochDur
+// milliseconds and starts a new epoch.
+func (s *sendStats) epochReset(epochDur int64) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.pps = float64(s.ppe) * 1000 / float64(epochDur)
+	s.bps = float64(s.bpe) * 1000 / float64(epochDur)
 	s.bpe = 0
 	s.ppe = 0
 }
 
+// domainKeyPorts is the number of source ports domain keys are assigned from.
+const domainKeyPorts = 64535
+
+// createDomainKeyTable assigns each of the keys (domains, or for http
+// templates see templateKeys) a unique random source port.
 func createDomainKeyTable(domains []string) (*KeyTable, error) {
+	if len(domains) > domainKeyPorts {
+		return nil, fmt.Errorf("too many keys for the source port space: %d > %d", len(domains), domainKeyPorts)
+	}
+
 	t := newKeyTable()
 	t.generate = func(s string) (interface{}, error) {
-		return int((rand.Int31() % 64535) + 1000), nil
+		return int((rand.Int31() % domainKeyPorts) + 1000), nil
 	}
 
 	for _, d := range domains {
@@ -123,26 +196,21 @@ type netLayer interface {
 func capturePcap(iface, pcapPath, bpfFilter string, exit chan struct{}, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	f, err := os.Create(pcapPath + ".gz")
+	// Write PCAP in compressed format, rotating if enabled.
+	w, err := newRotatingPcapWriter(pcapPath, 1600, layers.LinkTypeEthernet, pcapRotation)
 	if err != nil {
 		panic(err)
 	}
-	defer f.Close()
+	defer w.Close()
 
-	// Required otherwise io doesn't flush properly on deferred close
-	outWriter := bufio.NewWriter(f)
-	defer outWriter.Flush()
+	// count received packets by probe type
+	name := strings.TrimSuffix(filepath.Base(pcapPath), ".pcap")
 
-	// Write PCAP in compressed format.
-	filename := path.Base(pcapPath)
-	archiver := gzip.NewWriter(outWriter)
-	archiver.Name = filename
-	defer archiver.Close()
-
-	// Write PCAP
-	w := pcapgo.NewWriter(archiver)
-	if err := w.WriteFileHeader(1600, layers.LinkTypeEthernet); err != nil {
-		panic(err)
+	if captureOpts.backend == "afpacket" {
+		if err := captureAFPacket(iface, name, bpfFilter, w, exit); err != nil {
+			panic(err)
+		}
+		return
 	}
 
 	if handle, err := pcap.OpenLive(iface, 1600, true, pcap.BlockForever); err != nil {
@@ -151,6 +219,9 @@ func capturePcap(iface, pcapPath, bpfFilter string, exit chan struct{}, wg *sync
 		panic(err)
 	} else {
 		defer handle.Close()
+		// deferred after Close so the handle is unregistered before it closes
+		unregister := captureStats.register(pcapCounters(handle))
+		defer unregister()
 
 		packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
 		for packet := range packetSource.Packets() {
@@ -164,6 +235,7 @@ func capturePcap(iface, pcapPath, bpfFilter string, exit chan struct{}, wg *sync
 					log.Printf("pcap.WritePacket() error: %v", err)
 					return
 				}
+				stats.incReceived(name, classifyPacket(packet))
 			}
 		}
 	}
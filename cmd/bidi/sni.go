@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sniVariant selects how the tested domain appears in the ClientHello of tls,
+// esni, and ech probes, to characterize how DPI parses the SNI.
+type sniVariant string
+
+const (
+	// sniNormal sends the built (or fingerprint) ClientHello unchanged.
+	sniNormal sniVariant = "normal"
+	// sniNone omits the server_name extension.
+	sniNone sniVariant = "none"
+	// sniTrailingDot appends a dot to the server name, e.g. "example.com.".
+	sniTrailingDot sniVariant = "trailing-dot"
+	// sniMixedCase alternates the case of the letters of the server name,
+	// e.g. "ExAmPlE.cOm".
+	sniMixedCase sniVariant = "mixed-case"
+	// sniNullPad appends a null byte to the server name.
+	sniNullPad sniVariant = "null-pad"
+	// sniDouble sends two host_name entries for the domain in the
+	// server_name extension.
+	sniDouble sniVariant = "double"
+	// sniFirst moves the server_name extension to the first extension.
+	sniFirst sniVariant = "first"
+	// sniLast moves the server_name extension to the last extension.
+	sniLast sniVariant = "last"
+	// sniPadding omits the server_name extension and sends the domain as the
+	// data of a padding extension instead.
+	sniPadding sniVariant = "padding"
+)
+
+var sniVariants = []sniVariant{
+	sniNormal, sniNone, sniTrailingDot, sniMixedCase, sniNullPad,
+	sniDouble, sniFirst, sniLast, sniPadding,
+}
+
+func parseSNIVariant(s string) (sniVariant, error) {
+	if s == "" {
+		return sniNormal, nil
+	}
+
+	var names []string
+	for _, v := range sniVariants {
+		if string(v) == s {
+			return v, nil
+		}
+		names = append(names, string(v))
+	}
+	return "", fmt.Errorf("unknown sni variant \"%s\" - must be one of %s", s, strings.Join(names, ", "))
+}
+
+// hostName returns the domain name as it appears in the ClientHello.
+func (v sniVariant) hostName(name string) string {
+	switch v {
+	case sniTrailingDot:
+		return name + "."
+	case sniMixedCase:
+		return alternateCase(name)
+	case sniNullPad:
+		return name + "\x00"
+	default:
+		return name
+	}
+}
+
+// apply returns a copy of the ClientHello record hello, built for the domain
+// name, with the SNI rewritten for the variant. If pad is set the BoringSSL
+// style padding is recomputed for the new length.
+func (v sniVariant) apply(hello []byte, name string, pad bool) ([]byte, error) {
+	if v == "" || v == sniNormal {
+		return hello, nil
+	}
+
+	h, err := parseClientHello(hello)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v {
+	case sniNone:
+		h.removeExtension(extServerName)
+	case sniTrailingDot, sniMixedCase, sniNullPad:
+		h.setServerName(v.hostName(name))
+	case sniDouble:
+		h.setExtension(serverNameExtension(name, name))
+	case sniFirst, sniLast:
+		ext := serverNameExtension(name)
+		if i := h.extension(extServerName); i >= 0 {
+			ext = h.extensions[i]
+		}
+		h.removeExtension(extServerName)
+		if v == sniFirst {
+			h.insertExtension(0, ext)
+		} else {
+			h.extensions = append(h.extensions, ext)
+		}
+		// only the order changes, so the padding is still right
+		pad = false
+	case sniPadding:
+		h.removeExtension(extServerName)
+		h.setExtension(tlsExtension{extPadding, []byte(name)})
+		// the domain takes the place of the padding
+		pad = false
+	default:
+		return nil, fmt.Errorf("unknown sni variant \"%s\"", v)
+	}
+
+	if pad {
+		if err := h.padBoring(); err != nil {
+			return nil, err
+		}
+	}
+	return h.marshal()
+}
+
+// checkSplit returns an error if the tcp segmenter seg or the record splitter
+// records splits inside the domain while the variant leaves the domain out of
+// the ClientHello, so no split would be made.
+func (v sniVariant) checkSplit(seg *tcpSegmenter, records *tlsRecordSplitter) error {
+	if v != sniNone {
+		return nil
+	}
+	if seg != nil && seg.mode == "domain" {
+		return fmt.Errorf("tcp segment mode domain can not be used with sni variant %s - there is no domain to split", v)
+	}
+	if records != nil && records.seg.mode == "domain" {
+		return fmt.Errorf("tls records mode domain can not be used with sni variant %s - there is no domain to split", v)
+	}
+	return nil
+}
+
+// alternateCase upper cases every other letter of name starting with the
+// first.
+func alternateCase(name string) string {
+	b := []byte(name)
+	upper := true
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			if upper {
+				b[i] = c &^ 0x20
+			} else {
+				b[i] = c | 0x20
+			}
+			upper = !upper
+		}
+	}
+	return string(b)
+}
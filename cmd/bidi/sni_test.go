@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSNIVariants(t *testing.T) {
+	name := "example.com"
+
+	for _, v := range sniVariants {
+		for _, fingerprint := range []string{"", "chrome", "firefox", "safari"} {
+			p := &tlsProber{sni: v}
+			if fingerprint != "" {
+				tmpl, err := loadHelloTemplate(fingerprint)
+				require.Nil(t, err)
+				p.fingerprint = tmpl
+			}
+			label := string(v) + " " + fingerprint
+
+			out, err := p.buildPayload(name)
+			require.Nil(t, err, label)
+			helloExtensions(t, out)
+
+			h, err := parseClientHello(out)
+			require.Nil(t, err, label)
+			i := h.extension(extServerName)
+			last := len(h.extensions) - 1
+
+			if p.fingerprint.padded() && v != sniPadding {
+				requireBoringPadding(t, out)
+			}
+
+			switch v {
+			case sniNone:
+				require.Equal(t, -1, i, label)
+			case sniPadding:
+				require.Equal(t, -1, i, label)
+				j := h.extension(extPadding)
+				require.GreaterOrEqual(t, j, 0, label)
+				require.Equal(t, []byte(name), h.extensions[j].data, label)
+			case sniDouble:
+				require.Equal(t, serverNameExtension(name, name), h.extensions[i], label)
+			case sniFirst:
+				require.Equal(t, 0, i, label)
+				require.Equal(t, serverNameExtension(name), h.extensions[i], label)
+			case sniLast:
+				require.Equal(t, last, i, label)
+				require.Equal(t, serverNameExtension(name), h.extensions[i], label)
+			default:
+				require.GreaterOrEqual(t, i, 0, label)
+				require.Equal(t, serverNameExtension(v.hostName(name)), h.extensions[i], label)
+			}
+
+			if v != sniFirst && v != sniLast {
+				continue
+			}
+			// the other extensions keep their order
+			base, err := (&tlsProber{fingerprint: p.fingerprint}).buildPayload(name)
+			require.Nil(t, err)
+			hb, err := parseClientHello(base)
+			require.Nil(t, err)
+			hb.removeExtension(extServerName)
+			h.removeExtension(extServerName)
+			var types, baseTypes []uint16
+			for _, ext := range h.extensions {
+				types = append(types, ext.typ)
+			}
+			for _, ext := range hb.extensions {
+				baseTypes = append(baseTypes, ext.typ)
+			}
+			require.Equal(t, baseTypes, types, label)
+		}
+	}
+}
+
+func TestSNIHostName(t *testing.T) {
+	require.Equal(t, "ExAmPlE.cOm", sniMixedCase.hostName("example.com"))
+	require.Equal(t, "ExAmPlE.cOm", sniMixedCase.hostName("EXAMPLE.COM"))
+	require.Equal(t, "example.com.", sniTrailingDot.hostName("example.com"))
+	require.Equal(t, "example.com\x00", sniNullPad.hostName("example.com"))
+	require.Equal(t, "example.com", sniNone.hostName("example.com"))
+
+	v, err := parseSNIVariant("")
+	require.Nil(t, err)
+	require.Equal(t, sniNormal, v)
+	v, err = parseSNIVariant("double")
+	require.Nil(t, err)
+	require.Equal(t, sniDouble, v)
+	_, err = parseSNIVariant("triple")
+	require.NotNil(t, err)
+}
+
+func TestSNIVariantSplit(t *testing.T) {
+	none, err := parseSegmenter("none", "forward", 0)
+	require.Nil(t, err)
+	domain, err := parseSegmenter("domain", "forward", 0)
+	require.Nil(t, err)
+	records, err := parseRecordSplitter("domain")
+	require.Nil(t, err)
+
+	require.Nil(t, sniNone.checkSplit(none, nil))
+	require.NotNil(t, sniNone.checkSplit(domain, nil))
+	require.NotNil(t, sniNone.checkSplit(none, records))
+	require.Nil(t, sniNormal.checkSplit(domain, records))
+	require.Nil(t, sniPadding.checkSplit(domain, records))
+}
+
+func TestSNIVariantECH(t *testing.T) {
+	p := &echProber{send1_3: true, ech: true, sni: sniLast}
+	out, err := p.buildPayload("example.com")
+	require.Nil(t, err)
+
+	exts := helloExtensions(t, out)
+	require.Equal(t, 1, len(findExtension(exts, extECH)))
+	require.Equal(t, uint16(extServerName), binary.BigEndian.Uint16(exts[len(exts)-1]))
+}
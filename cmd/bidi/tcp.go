@@ -17,17 +17,58 @@ import (
 )
 
 type tcpSender struct {
-	src4 net.IP
-	src6 net.IP
+	src4 *addrPool
+	src6 *addrPool
+
+	// srcPerProbe assigns source addresses round robin for each probe rather
+	// than keeping one source address per target.
+	srcPerProbe bool
 
 	// sendSynAndAck sends a syn and an ack packet as a pseudo prelude to a TCP
 	// session in order to trigger censorship responses from middle-boxes expecting
 	// and tracking some subset of the TCP flow state.
 	sendSynAndAck bool
-	synDelay      time.Duration
+
+	// synDelay is the delay between the syn and the ack (or between the syn
+	// and the data if synOnly is set).
+	synDelay time.Duration
+	// ackDelay is the delay between the ack and the data.
+	ackDelay time.Duration
+	// dupDelay is the delay after which the data packets are sent a second
+	// time. 0 disables duplicate data.
+	dupDelay time.Duration
+	// synOnly sends the syn without an ack before the data.
+	synOnly bool
+
+	// repeat retransmits the data packets of each probe when in identical
+	// mode. nil sends each probe once.
+	repeat *probeRepeat
 
 	checksums bool
 
+	// profile controls the TCP header fields and options of the syn, ack, and
+	// data packets.
+	profile *tcpProfile
+
+	// segmenter splits the payload across multiple data packets. nil sends
+	// the payload in a single packet.
+	segmenter *tcpSegmenter
+
+	// fragmenter splits data packets into IP fragments. nil disables IP
+	// fragmentation.
+	fragmenter *ipFragmenter
+
+	// ext6 are IPv6 extension headers inserted into every IPv6 packet.
+	ext6 []ipv6ExtHeader
+
+	// handshake tracks syn-acks for stateful probes sent on genuine TCP
+	// connections. nil sends the syn / ack prelude blindly (if enabled).
+	handshake *handshakeTracker
+
+	// residual schedules control probes after each probe to measure residual
+	// censorship. nil disables residual measurement.
+	residual *residualScheduler
+
 	device  string
 	sockFd4 int
 	sockFd6 int
@@ -43,12 +84,12 @@ func newTCPSender(device, lAddr4, lAddr6 string, synAck bool, synDelay time.Dura
 		return nil, fmt.Errorf("bad device name: \"%s\"", device)
 	}
 
-	localIP4, err := getSrcIP(localIface, lAddr4, net.ParseIP("1.2.3.4"))
+	localIP4, err := newAddrPool(localIface, lAddr4+","+lAddr6, net.ParseIP("1.2.3.4"))
 	if err != nil {
 		return nil, err
 	}
 
-	localIP6, err := getSrcIP(localIface, lAddr6, net.ParseIP("2606:4700::"))
+	localIP6, err := newAddrPool(localIface, lAddr4+","+lAddr6, net.ParseIP("2606:4700::"))
 	if err != nil {
 		log.Println("failed to init IPv6 - likely not supported")
 	}
@@ -63,6 +104,11 @@ func newTCPSender(device, lAddr4, lAddr6 string, synAck bool, synDelay time.Dura
 		return nil, os.NewSyscallError("socket", err)
 	}
 
+	profile, err := loadTCPProfile("default")
+	if err != nil {
+		return nil, err
+	}
+
 	t := &tcpSender{
 		src4:   localIP4,
 		src6:   localIP6,
@@ -72,6 +118,7 @@ func newTCPSender(device, lAddr4, lAddr6 string, synAck bool, synDelay time.Dura
 		synDelay:      synDelay,
 
 		checksums: checksums,
+		profile:   profile,
 
 		sockFd4: fd4,
 		sockFd6: fd6,
@@ -80,28 +127,64 @@ func newTCPSender(device, lAddr4, lAddr6 string, synAck bool, synDelay time.Dura
 	return t, nil
 }
 
+// timing describes the packet timing used for probes for the send log.
+func (t *tcpSender) timing() string {
+	dup := "none"
+	if t.dupDelay > 0 {
+		dup = t.dupDelay.String()
+	}
+
+	switch {
+	case t.synOnly:
+		return fmt.Sprintf("syn-only syn-data:%s dup:%s", t.synDelay, dup)
+	case t.handshake != nil:
+		return fmt.Sprintf("stateful ack-data:%s dup:%s", t.ackDelay, dup)
+	case t.sendSynAndAck:
+		return fmt.Sprintf("syn-ack syn-ack:%s ack-data:%s dup:%s", t.synDelay, t.ackDelay, dup)
+	default:
+		return fmt.Sprintf("data-only dup:%s", dup)
+	}
+}
+
 func (t *tcpSender) clean() {
 	syscall.Close(t.sockFd4)
 	syscall.Close(t.sockFd6)
+	t.handshake.close()
 }
 
-func (t *tcpSender) sendTCP(dst string, sport int, domain string, payload []byte, verbose bool) (string, int, error) {
+// sendTCP sends the payload to dst (ip:port) with the syn / ack prelude if
+// enabled. Returns the sequence and ack numbers used (as hex) and the local
+// address (ip:port) that the probe was sent from.
+func (t *tcpSender) sendTCP(dst string, sport int, domain string, payload []byte, verbose bool) (string, string, error) {
 
 	host, portStr, err := net.SplitHostPort(dst)
 	if err != nil {
-		return "", -1, fmt.Errorf("failed to parse \"ip:port\": %s - %s", dst, err)
+		return "", "", fmt.Errorf("failed to parse \"ip:port\": %s - %s", dst, err)
 	}
 	port, _ := strconv.Atoi(portStr)
 
 	ip := net.ParseIP(host)
 
 	var useV4 = ip.To4() != nil
+	var src net.IP
 	if useV4 && t.src4 == nil {
-		return "", -1, fmt.Errorf("no IPv4 address available")
+		return "", "", fmt.Errorf("no IPv4 address available")
 	} else if !useV4 && t.src6 == nil {
-		return "", -1, fmt.Errorf("no IPv6 address available")
+		return "", "", fmt.Errorf("no IPv6 address available")
+	} else if useV4 {
+		src = t.src4.pick(ip, t.srcPerProbe)
+	} else {
+		src = t.src6.pick(ip, t.srcPerProbe)
 	}
 
+	return t.sendTCPFrom(src, ip, port, sport, domain, payload, verbose)
+}
+
+// sendTCPFrom sends the payload from the src address to ip:port. See sendTCP.
+func (t *tcpSender) sendTCPFrom(src, ip net.IP, port, sport int, domain string, payload []byte, verbose bool) (string, string, error) {
+	var err error
+	var useV4 = ip.To4() != nil
+
 	options := gopacket.SerializeOptions{
 		FixLengths:       true,
 		ComputeChecksums: t.checksums,
@@ -128,23 +211,13 @@ func (t *tcpSender) sendTCP(dst string, sport int, domain string, payload []byte
 		// response packets. RST packets generally don't set their ACK value :(
 	}
 
-	// Fill TCP  Payload layer details
-	tcpLayer := layers.TCP{
-		SrcPort: layers.TCPPort(sport),
-		DstPort: layers.TCPPort(port),
-		PSH:     true,
-		ACK:     true,
-		Window:  502,
-		Seq:     seq + 1,
-		Ack:     ack,
-	}
 	seqAck := fmt.Sprintf("%x %x", seq+1, ack)
 
 	// Fill out gopacket IP header with source and dest JUST for Data layer checksums
 	var networkLayer netLayer
 	if useV4 {
 		ipLayer4 := &layers.IPv4{
-			SrcIP:    t.src4,
+			SrcIP:    src,
 			DstIP:    ip,
 			Version:  4,
 			TTL:      64,
@@ -154,7 +227,7 @@ func (t *tcpSender) sendTCP(dst string, sport int, domain string, payload []byte
 		networkLayer = ipLayer4
 	} else {
 		ipLayer6 := &layers.IPv6{
-			SrcIP:      t.src6,
+			SrcIP:      src,
 			DstIP:      ip,
 			Version:    6,
 			HopLimit:   64,
@@ -164,26 +237,6 @@ func (t *tcpSender) sendTCP(dst string, sport int, domain string, payload []byte
 		networkLayer = ipLayer6
 	}
 
-	tcpLayer.SetNetworkLayerForChecksum(networkLayer)
-
-	// build syn, ack, and data payloads
-	synBuf, err := getSyn(uint32(sport), uint32(port), seq, options, networkLayer)
-	if err != nil {
-		return "", -1, err
-	}
-	ackBuf, err := getAck(uint32(sport), uint32(port), seq+1, ack, options, networkLayer)
-	if err != nil {
-		return "", -1, err
-	}
-
-	tcpPayloadBuf := gopacket.NewSerializeBuffer()
-	err = gopacket.SerializeLayers(tcpPayloadBuf, options, networkLayer, &tcpLayer, gopacket.Payload(payload))
-	if err != nil {
-		return "", -1, err
-	}
-	// XXX end of packet creation
-
-	// XXX send packet
 	var addr syscall.Sockaddr
 	var sockFd int
 	if useV4 {
@@ -200,26 +253,134 @@ func (t *tcpSender) sendTCP(dst string, sport int, domain string, payload []byte
 		}
 	}
 
-	if t.sendSynAndAck {
+	synBuf, err := getSyn(&t.profile.Syn, uint32(sport), uint32(port), seq, options, networkLayer)
+	if err != nil {
+		return "", "", err
+	}
+	synBuf, err = withIPv6ExtHeaders(synBuf, t.ext6)
+	if err != nil {
+		return "", "", err
+	}
+
+	if t.handshake != nil {
+		// Stateful - send the syn and wait for the genuine syn-ack so that the
+		// ack and data packets carry the correct ack number.
+		key := t.handshake.expect(src, sport, ip, port)
 		err = sendPkt(sockFd, synBuf, addr)
 		if err != nil {
-			return "", -1, err
+			return "", "", err
 		}
 
-		time.Sleep(t.synDelay)
+		isn, err := t.handshake.wait(key)
+		if err != nil {
+			return "", "", err
+		}
+		ack = isn + 1
+		seqAck = fmt.Sprintf("%x %x", seq+1, ack)
+	}
+
+	// build ack, data, and rst payloads
+	ackBuf, err := getAck(&t.profile.Ack, uint32(sport), uint32(port), seq+1, ack, options, networkLayer)
+	if err != nil {
+		return "", "", err
+	}
+
+	dataBufs, err := t.getData(uint32(sport), uint32(port), seq+1, ack, domain, payload, options, networkLayer)
+	if err != nil {
+		return "", "", err
+	}
+
+	var rstBuf []byte
+	if t.handshake != nil {
+		dataLen := len(t.profile.Data.withUrgentData(payload))
+		rstBuf, err = getRst(uint32(sport), uint32(port), seq+1+uint32(dataLen), ack, options, networkLayer)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	if !useV4 && len(t.ext6) > 0 {
+		ackBuf, err = withIPv6ExtHeaders(ackBuf, t.ext6)
+		if err != nil {
+			return "", "", err
+		}
+		for i := range dataBufs {
+			dataBufs[i], err = withIPv6ExtHeaders(dataBufs[i], t.ext6)
+			if err != nil {
+				return "", "", err
+			}
+		}
+		rstBuf, err = withIPv6ExtHeaders(rstBuf, t.ext6)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	// XXX end of packet creation
+
+	// XXX send packet
+	if t.handshake == nil && (t.sendSynAndAck || t.synOnly) {
+		err = sendPkt(sockFd, synBuf, addr)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	if (t.handshake != nil || t.sendSynAndAck) && !t.synOnly {
+		if t.handshake == nil {
+			time.Sleep(t.synDelay)
+		}
 
 		err = sendPkt(sockFd, ackBuf, addr)
 		if err != nil {
-			return "", -1, err
+			return "", "", err
 		}
+
+		time.Sleep(t.ackDelay)
+	} else if t.synOnly {
+		time.Sleep(t.synDelay)
 	}
 
-	err = sendPkt(sockFd, tcpPayloadBuf.Bytes(), addr)
+	sendData := func() error {
+		for _, dataBuf := range dataBufs {
+			err := sendFragmented(sockFd, dataBuf, addr, t.fragmenter)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err = sendData()
 	if err != nil {
-		return "", -1, err
+		return "", "", err
+	}
+
+	if t.dupDelay > 0 {
+		err = retransmit(1, t.dupDelay, sendData)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	if n := t.repeat.identical(); n > 0 {
+		err = retransmit(n, t.repeat.interval, sendData)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	laddr := net.JoinHostPort(src.String(), strconv.Itoa(sport))
+	if t.handshake != nil {
+		// tear down the genuine connection once the server has had a chance
+		// to respond to the data.
+		t.handshake.teardown(func() {
+			if err := sendPkt(sockFd, rstBuf, addr); err != nil {
+				log.Printf("failed to send rst %s -> %s: %s", laddr, ip, err)
+			}
+		})
 	}
 
-	return seqAck, int(sport), nil
+	return seqAck, laddr, nil
 }
 
 func sendPkt(sockFd int, payload []byte, addr syscall.Sockaddr) error {
@@ -231,77 +392,89 @@ func sendPkt(sockFd int, payload []byte, addr syscall.Sockaddr) error {
 		if err == nil {
 			stats.incPacketPerSec()
 			stats.incBytesPerSec(len(payload))
+			sentPcap.record(payload)
 			return nil
 		}
-		if err != nil {
+		// only count a retry if another attempt follows, a final failure is
+		// counted as an error
+		if i < retries-1 {
+			stats.incRetry()
 			time.Sleep(retryDelay)
 		}
 	}
 
+	stats.incError()
 	return os.NewSyscallError("sendto", err)
 }
 
-func getSyn(srcPort, dstPort, seq uint32, options gopacket.SerializeOptions, ipLayer netLayer) ([]byte, error) {
-	synLayer := layers.TCP{
-		SrcPort: layers.TCPPort(srcPort),
-		DstPort: layers.TCPPort(dstPort),
-		SYN:     true,
-		Window:  28800,
-		Seq:     seq,
-		Ack:     0,
-		Options: []layers.TCPOption{
-			layers.TCPOption{
-				OptionType:   layers.TCPOptionKindMSS,
-				OptionLength: 4,
-				OptionData:   []byte{0x05, 0xa0},
-			},
-			layers.TCPOption{
-				OptionType:   layers.TCPOptionKindSACKPermitted,
-				OptionLength: 2,
-			},
-			layers.TCPOption{
-				OptionType: layers.TCPOptionKindNop,
-			},
-			layers.TCPOption{
-				OptionType:   layers.TCPOptionKindWindowScale,
-				OptionLength: 3,
-				OptionData:   []byte{0x07},
-			},
-		},
+// getData builds the data packets carrying the payload, split into segments
+// according to the sender's segmenter. Segment sequence numbers are offset from
+// seq (the sequence number following the syn) so that they stay consistent
+// with the syn / ack prelude.
+func (t *tcpSender) getData(srcPort, dstPort, seq, ack uint32, domain string, payload []byte, options gopacket.SerializeOptions, ipLayer netLayer) ([][]byte, error) {
+	payload = t.profile.Data.withUrgentData(payload)
+
+	segments := []tcpSegment{{offset: 0, data: payload}}
+	if t.segmenter != nil {
+		segments = t.segmenter.split(payload, domain)
 	}
 
+	var bufs [][]byte
+	for _, segment := range segments {
+		tcpLayer := t.profile.Data.dataLayer(srcPort, dstPort, seq+uint32(segment.offset), ack, segment.offset)
+		tcpLayer.SetNetworkLayerForChecksum(ipLayer)
+
+		tcpPayloadBuf := gopacket.NewSerializeBuffer()
+		err := gopacket.SerializeLayers(tcpPayloadBuf, options, ipLayer, tcpLayer, gopacket.Payload(segment.data))
+		if err != nil {
+			return nil, err
+		}
+		bufs = append(bufs, tcpPayloadBuf.Bytes())
+	}
+
+	return bufs, nil
+}
+
+func getSyn(pp *tcpPacketProfile, srcPort, dstPort, seq uint32, options gopacket.SerializeOptions, ipLayer netLayer) ([]byte, error) {
+	synLayer := pp.layer(srcPort, dstPort, seq, 0)
+
 	synLayer.SetNetworkLayerForChecksum(ipLayer)
 
 	tcpPayloadBuf := gopacket.NewSerializeBuffer()
-	err := gopacket.SerializeLayers(tcpPayloadBuf, options, ipLayer, &synLayer)
+	err := gopacket.SerializeLayers(tcpPayloadBuf, options, ipLayer, synLayer)
 	if err != nil {
 		return nil, err
 	}
 	return tcpPayloadBuf.Bytes(), nil
 }
-func getAck(srcPort, dstPort, seq, ack uint32, options gopacket.SerializeOptions, ipLayer netLayer) ([]byte, error) {
+func getAck(pp *tcpPacketProfile, srcPort, dstPort, seq, ack uint32, options gopacket.SerializeOptions, ipLayer netLayer) ([]byte, error) {
+
+	ackLayer := pp.layer(srcPort, dstPort, seq, ack)
 
-	ackLayer := &layers.TCP{
+	ackLayer.SetNetworkLayerForChecksum(ipLayer)
+
+	tcpPayloadBuf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(tcpPayloadBuf, options, ipLayer, ackLayer)
+	if err != nil {
+		return nil, err
+	}
+	return tcpPayloadBuf.Bytes(), nil
+}
+
+func getRst(srcPort, dstPort, seq, ack uint32, options gopacket.SerializeOptions, ipLayer netLayer) ([]byte, error) {
+	rstLayer := &layers.TCP{
 		SrcPort: layers.TCPPort(srcPort),
 		DstPort: layers.TCPPort(dstPort),
-		ACK:     true,
-		Window:  225,
 		Seq:     seq,
 		Ack:     ack,
-		Options: []layers.TCPOption{
-			layers.TCPOption{
-				OptionType: layers.TCPOptionKindNop,
-			},
-			layers.TCPOption{
-				OptionType: layers.TCPOptionKindNop,
-			},
-		},
+		RST:     true,
+		ACK:     true,
 	}
 
-	ackLayer.SetNetworkLayerForChecksum(ipLayer)
+	rstLayer.SetNetworkLayerForChecksum(ipLayer)
 
 	tcpPayloadBuf := gopacket.NewSerializeBuffer()
-	err := gopacket.SerializeLayers(tcpPayloadBuf, options, ipLayer, ackLayer)
+	err := gopacket.SerializeLayers(tcpPayloadBuf, options, ipLayer, rstLayer)
 	if err != nil {
 		return nil, err
 	}
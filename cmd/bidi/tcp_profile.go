@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// tcpPacketProfile describes the TCP header fields used for one of the
+// packets (syn, ack, or data) sent by the tcpSender.
+//
+// Flags are given as a string of single character flag names in the style of
+// tcpdump / scapy - F(IN) S(YN) R(ST) P(SH) A(CK) U(RG) E(CE) C(WR) N(S).
+//
+// Options are given as a comma separated list of option names in the order
+// that they should appear in the header. Supported options are:
+//
+//	mss[:N]   - maximum segment size (default 1460)
+//	sack      - SACK permitted
+//	ts        - timestamps (TSval taken from the clock, TSecr 0)
+//	ws[:N]    - window scale (default 7)
+//	nop       - no-op (padding)
+//	eol       - end of option list
+//	none      - no options (same as an empty list)
+//
+// UrgentData is prepended to the payload of data packets and the URG flag and
+// urgent pointer are set to cover it. It has no effect on syn and ack packets.
+type tcpPacketProfile struct {
+	Flags      string `json:"flags"`
+	Window     uint16 `json:"window"`
+	Options    string `json:"options"`
+	UrgentData string `json:"urgent_data,omitempty"`
+
+	flags uint16
+	opts  []tcpOptionSpec
+}
+
+// tcpProfile describes the TCP headers of every packet sent for a tcp probe.
+type tcpProfile struct {
+	Syn  tcpPacketProfile `json:"syn"`
+	Ack  tcpPacketProfile `json:"ack"`
+	Data tcpPacketProfile `json:"data"`
+}
+
+type tcpOptionSpec struct {
+	kind layers.TCPOptionKind
+	data []byte
+}
+
+const (
+	tcpFlagFIN uint16 = 1 << iota
+	tcpFlagSYN
+	tcpFlagRST
+	tcpFlagPSH
+	tcpFlagACK
+	tcpFlagURG
+	tcpFlagECE
+	tcpFlagCWR
+	tcpFlagNS
+)
+
+var tcpFlagNames = map[rune]uint16{
+	'F': tcpFlagFIN,
+	'S': tcpFlagSYN,
+	'R': tcpFlagRST,
+	'P': tcpFlagPSH,
+	'A': tcpFlagACK,
+	'U': tcpFlagURG,
+	'E': tcpFlagECE,
+	'C': tcpFlagCWR,
+	'N': tcpFlagNS,
+}
+
+// builtinTCPProfiles are selectable by name using the -tcp-profile option.
+// The "default" profile reproduces the headers the prober has always sent.
+var builtinTCPProfiles = map[string]tcpProfile{
+	"default": {
+		Syn:  tcpPacketProfile{Flags: "S", Window: 28800, Options: "mss:1440,sack,nop,ws:7"},
+		Ack:  tcpPacketProfile{Flags: "A", Window: 225, Options: "nop,nop"},
+		Data: tcpPacketProfile{Flags: "PA", Window: 502, Options: "none"},
+	},
+	"linux": {
+		Syn:  tcpPacketProfile{Flags: "S", Window: 64240, Options: "mss:1460,sack,ts,nop,ws:7"},
+		Ack:  tcpPacketProfile{Flags: "A", Window: 502, Options: "nop,nop,ts"},
+		Data: tcpPacketProfile{Flags: "PA", Window: 502, Options: "nop,nop,ts"},
+	},
+	"windows": {
+		Syn:  tcpPacketProfile{Flags: "S", Window: 64240, Options: "mss:1460,nop,ws:8,nop,nop,sack"},
+		Ack:  tcpPacketProfile{Flags: "A", Window: 1026, Options: "none"},
+		Data: tcpPacketProfile{Flags: "PA", Window: 1026, Options: "none"},
+	},
+	"macos": {
+		Syn:  tcpPacketProfile{Flags: "S", Window: 65535, Options: "mss:1460,nop,ws:6,nop,nop,ts,sack,eol"},
+		Ack:  tcpPacketProfile{Flags: "A", Window: 2058, Options: "nop,nop,ts"},
+		Data: tcpPacketProfile{Flags: "PA", Window: 2058, Options: "nop,nop,ts"},
+	},
+	"bare": {
+		Syn:  tcpPacketProfile{Flags: "S", Window: 65535, Options: "none"},
+		Ack:  tcpPacketProfile{Flags: "A", Window: 65535, Options: "none"},
+		Data: tcpPacketProfile{Flags: "PA", Window: 65535, Options: "none"},
+	},
+}
+
+// loadTCPProfile returns the builtin profile with the given name, or if there
+// is no builtin profile by that name, reads the profile from a json file at
+// that path. Fields omitted from the file keep their "default" values.
+func loadTCPProfile(nameOrPath string) (*tcpProfile, error) {
+	if nameOrPath == "" {
+		nameOrPath = "default"
+	}
+
+	var p tcpProfile
+	if builtin, ok := builtinTCPProfiles[nameOrPath]; ok {
+		p = builtin
+	} else {
+		content, err := os.ReadFile(nameOrPath)
+		if err != nil {
+			return nil, fmt.Errorf("unknown tcp profile \"%s\": %s", nameOrPath, err)
+		}
+
+		p = builtinTCPProfiles["default"]
+		err = json.Unmarshal(content, &p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse tcp profile: %s", err)
+		}
+	}
+
+	for _, pp := range []*tcpPacketProfile{&p.Syn, &p.Ack, &p.Data} {
+		if err := pp.parse(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &p, nil
+}
+
+func (pp *tcpPacketProfile) parse() error {
+	flags, err := parseTCPFlags(pp.Flags)
+	if err != nil {
+		return err
+	}
+
+	opts, err := parseTCPOptions(pp.Options)
+	if err != nil {
+		return err
+	}
+
+	pp.flags = flags
+	pp.opts = opts
+	return nil
+}
+
+func parseTCPFlags(s string) (uint16, error) {
+	var flags uint16
+	for _, c := range strings.ToUpper(s) {
+		f, ok := tcpFlagNames[c]
+		if !ok {
+			return 0, fmt.Errorf("unknown tcp flag '%c' in \"%s\"", c, s)
+		}
+		flags |= f
+	}
+	return flags, nil
+}
+
+func parseTCPOptions(s string) ([]tcpOptionSpec, error) {
+	var opts []tcpOptionSpec
+	if s == "" || s == "none" {
+		return opts, nil
+	}
+
+	for _, o := range strings.Split(s, ",") {
+		name, arg, hasArg := strings.Cut(strings.TrimSpace(o), ":")
+
+		var spec tcpOptionSpec
+		switch name {
+		case "mss":
+			mss := uint64(1460)
+			if hasArg {
+				var err error
+				mss, err = strconv.ParseUint(arg, 10, 16)
+				if err != nil {
+					return nil, fmt.Errorf("bad mss value \"%s\": %s", arg, err)
+				}
+			}
+			spec = tcpOptionSpec{kind: layers.TCPOptionKindMSS, data: binary.BigEndian.AppendUint16(nil, uint16(mss))}
+		case "sack":
+			spec = tcpOptionSpec{kind: layers.TCPOptionKindSACKPermitted}
+		case "ts":
+			spec = tcpOptionSpec{kind: layers.TCPOptionKindTimestamps, data: make([]byte, 8)}
+		case "ws":
+			ws := uint64(7)
+			if hasArg {
+				var err error
+				ws, err = strconv.ParseUint(arg, 10, 8)
+				if err != nil {
+					return nil, fmt.Errorf("bad window scale value \"%s\": %s", arg, err)
+				}
+			}
+			spec = tcpOptionSpec{kind: layers.TCPOptionKindWindowScale, data: []byte{byte(ws)}}
+		case "nop":
+			spec = tcpOptionSpec{kind: layers.TCPOptionKindNop}
+		case "eol":
+			spec = tcpOptionSpec{kind: layers.TCPOptionKindEndList}
+		default:
+			return nil, fmt.Errorf("unknown tcp option \"%s\"", name)
+		}
+		opts = append(opts, spec)
+	}
+
+	return opts, nil
+}
+
+// layer fills out a TCP layer for a packet using the profile.
+func (pp *tcpPacketProfile) layer(srcPort, dstPort, seq, ack uint32) *layers.TCP {
+	l := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Window:  pp.Window,
+		Seq:     seq,
+		Ack:     ack,
+
+		FIN: pp.flags&tcpFlagFIN != 0,
+		SYN: pp.flags&tcpFlagSYN != 0,
+		RST: pp.flags&tcpFlagRST != 0,
+		PSH: pp.flags&tcpFlagPSH != 0,
+		ACK: pp.flags&tcpFlagACK != 0,
+		URG: pp.flags&tcpFlagURG != 0,
+		ECE: pp.flags&tcpFlagECE != 0,
+		CWR: pp.flags&tcpFlagCWR != 0,
+		NS:  pp.flags&tcpFlagNS != 0,
+	}
+
+	for _, o := range pp.opts {
+		opt := layers.TCPOption{OptionType: o.kind}
+		switch o.kind {
+		case layers.TCPOptionKindNop, layers.TCPOptionKindEndList:
+			opt.OptionLength = 1
+		case layers.TCPOptionKindTimestamps:
+			opt.OptionData = binary.BigEndian.AppendUint32(nil, uint32(time.Now().UnixMilli()))
+			opt.OptionData = append(opt.OptionData, 0, 0, 0, 0)
+			opt.OptionLength = 10
+		default:
+			opt.OptionData = o.data
+			opt.OptionLength = uint8(2 + len(o.data))
+		}
+		l.Options = append(l.Options, opt)
+	}
+
+	return l
+}
+
+// withUrgentData returns the payload with any configured urgent data prepended.
+func (pp *tcpPacketProfile) withUrgentData(payload []byte) []byte {
+	if pp.UrgentData == "" || len(payload) == 0 {
+		return payload
+	}
+	return append([]byte(pp.UrgentData), payload...)
+}
+
+// dataLayer fills out a TCP layer for a data segment starting at offset in the
+// payload (as returned by withUrgentData). Segments covering urgent data get
+// the URG flag and an urgent pointer relative to the start of the segment.
+func (pp *tcpPacketProfile) dataLayer(srcPort, dstPort, seq, ack uint32, offset int) *layers.TCP {
+	l := pp.layer(srcPort, dstPort, seq, ack)
+	if ptr := len(pp.UrgentData) - offset; ptr > 0 {
+		l.URG = true
+		l.Urgent = uint16(ptr)
+	}
+	return l
+}
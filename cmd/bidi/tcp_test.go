@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+)
+
+func testIPv4Layer() *layers.IPv4 {
+	return &layers.IPv4{
+		SrcIP:    net.ParseIP("192.168.0.1"),
+		DstIP:    net.ParseIP("192.168.0.2"),
+		Version:  4,
+		TTL:      64,
+		Id:       1234,
+		Protocol: layers.IPProtocolTCP,
+	}
+}
+
+// The default profile should produce exactly the syn packet that was
+// previously hardcoded in getSyn.
+func TestTCPProfileDefaultSyn(t *testing.T) {
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	profile, err := loadTCPProfile("default")
+	require.Nil(t, err)
+
+	ipLayer := testIPv4Layer()
+	synBuf, err := getSyn(&profile.Syn, 1234, 443, 5678, options, ipLayer)
+	require.Nil(t, err)
+
+	synLayer := layers.TCP{
+		SrcPort: 1234,
+		DstPort: 443,
+		SYN:     true,
+		Window:  28800,
+		Seq:     5678,
+		Options: []layers.TCPOption{
+			{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xa0}},
+			{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+			{OptionType: layers.TCPOptionKindNop},
+			{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{0x07}},
+		},
+	}
+	synLayer.SetNetworkLayerForChecksum(ipLayer)
+	buf := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buf, options, ipLayer, &synLayer)
+	require.Nil(t, err)
+
+	require.Equal(t, hex.EncodeToString(buf.Bytes()), hex.EncodeToString(synBuf))
+}
+
+func TestTCPProfileFlags(t *testing.T) {
+	flags, err := parseTCPFlags("pa")
+	require.Nil(t, err)
+	require.Equal(t, tcpFlagPSH|tcpFlagACK, flags)
+
+	flags, err = parseTCPFlags("FSRPAUECN")
+	require.Nil(t, err)
+	require.Equal(t, uint16(0x1ff), flags)
+
+	_, err = parseTCPFlags("SX")
+	require.NotNil(t, err)
+}
+
+func TestTCPProfileOptions(t *testing.T) {
+	_, err := parseTCPOptions("mss:99999")
+	require.NotNil(t, err)
+	_, err = parseTCPOptions("bogus")
+	require.NotNil(t, err)
+
+	profile, err := loadTCPProfile("linux")
+	require.Nil(t, err)
+
+	l := profile.Syn.layer(1, 2, 3, 0)
+	require.True(t, l.SYN)
+	require.False(t, l.ACK)
+	require.Equal(t, 5, len(l.Options))
+	require.Equal(t, layers.TCPOptionKind(layers.TCPOptionKindTimestamps), l.Options[2].OptionType)
+	require.Equal(t, 8, len(l.Options[2].OptionData))
+}
+
+func TestTCPProfileFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profile.json")
+	err := os.WriteFile(path, []byte(`{"data": {"flags": "A", "window": 0, "options": "nop,eol", "urgent_data": "xx"}}`), 0644)
+	require.Nil(t, err)
+
+	profile, err := loadTCPProfile(path)
+	require.Nil(t, err)
+
+	// omitted packets keep their default values
+	require.Equal(t, uint16(28800), profile.Syn.Window)
+	require.Equal(t, uint16(225), profile.Ack.Window)
+
+	payload := profile.Data.withUrgentData([]byte("GET"))
+	require.Equal(t, "xxGET", string(payload))
+
+	l := profile.Data.dataLayer(1, 2, 3, 4, 0)
+	require.True(t, l.ACK)
+	require.True(t, l.URG)
+	require.False(t, l.PSH)
+	require.Equal(t, uint16(0), l.Window)
+	require.Equal(t, uint16(2), l.Urgent)
+
+	// segments past the urgent data do not carry the urgent pointer
+	l = profile.Data.dataLayer(1, 2, 5, 4, 2)
+	require.False(t, l.URG)
+	require.Equal(t, uint16(0), l.Urgent)
+
+	_, err = loadTCPProfile(filepath.Join(t.TempDir(), "missing.json"))
+	require.NotNil(t, err)
+}
+
+func joinSegments(segments []tcpSegment) string {
+	var out []byte
+	for _, s := range segments {
+		if end := s.offset + len(s.data); end > len(out) {
+			out = append(out, make([]byte, end-len(out))...)
+		}
+		copy(out[s.offset:], s.data)
+	}
+	return string(out)
+}
+
+func TestSegmenterModes(t *testing.T) {
+	payload := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	s, err := parseSegmenter("none", "forward", 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(s.split(payload, "example.com")))
+
+	s, err = parseSegmenter("offset:4", "forward", 0)
+	require.Nil(t, err)
+	segments := s.split(payload, "example.com")
+	require.Equal(t, 2, len(segments))
+	require.Equal(t, "GET ", string(segments[0].data))
+	require.Equal(t, 4, segments[1].offset)
+	require.Equal(t, string(payload), joinSegments(segments))
+
+	s, err = parseSegmenter("domain", "reverse", 0)
+	require.Nil(t, err)
+	segments = s.split(payload, "example.com")
+	require.Equal(t, 2, len(segments))
+	require.Equal(t, "le.com\r\n\r\n", string(segments[0].data))
+	require.Equal(t, 0, segments[1].offset)
+	require.Equal(t, string(payload), joinSegments(segments))
+
+	// domain not in the payload is sent in one segment
+	require.Equal(t, 1, len(s.split(payload, "example.org")))
+
+	s, err = parseSegmenter("equal:5", "forward", 0)
+	require.Nil(t, err)
+	segments = s.split(payload, "example.com")
+	require.Equal(t, 5, len(segments))
+	require.Equal(t, string(payload), joinSegments(segments))
+
+	// offsets past the end of the payload are ignored
+	s, err = parseSegmenter("offset:1000", "forward", 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(s.split(payload, "example.com")))
+
+	for _, bad := range []string{"offset", "equal:0", "offset:x", "bogus"} {
+		_, err = parseSegmenter(bad, "forward", 0)
+		require.NotNil(t, err, bad)
+	}
+	_, err = parseSegmenter("none", "sideways", 0)
+	require.NotNil(t, err)
+}
+
+func TestSegmenterOverlap(t *testing.T) {
+	payload := []byte("0123456789")
+
+	s, err := parseSegmenter("offset:4", "forward", 3)
+	require.Nil(t, err)
+	segments := s.split(payload, "")
+	require.Equal(t, 2, len(segments))
+	require.Equal(t, 7, len(segments[0].data))
+	require.Equal(t, "0123", string(segments[0].data[:4]))
+	require.NotEqual(t, "456", string(segments[0].data[4:]))
+	require.Equal(t, "456789", string(segments[1].data))
+
+	// overlap is capped at the length of the following segment
+	s, err = parseSegmenter("offset:8", "forward", 5)
+	require.Nil(t, err)
+	segments = s.split(payload, "")
+	require.Equal(t, 10, len(segments[0].data))
+}
+
+func TestResidualScheduler(t *testing.T) {
+	r, err := newResidualScheduler("", "v4vsv6.com")
+	require.Nil(t, err)
+	require.Nil(t, r)
+	require.Nil(t, r.schedule(nil, "", "", "", nil, false))
+	r.wait()
+
+	r, err = newResidualScheduler("10s, 1m,2m30s", "v4vsv6.com")
+	require.Nil(t, err)
+	require.Equal(t, []time.Duration{10 * time.Second, time.Minute, 150 * time.Second}, r.delays)
+	require.Equal(t, "v4vsv6.com after 10s,1m0s,2m30s", r.String())
+
+	for _, bad := range []string{"10", "-1s", "0s", "1s,x"} {
+		_, err = newResidualScheduler(bad, "v4vsv6.com")
+		require.NotNil(t, err, bad)
+	}
+	_, err = newResidualScheduler("1s", "")
+	require.NotNil(t, err)
+}
+
+func TestResidualSchedulerQueue(t *testing.T) {
+	r, err := newResidualScheduler("30ms,10ms", "v4vsv6.com")
+	require.Nil(t, err)
+
+	// each control probe is sent once, no earlier than its delay after the
+	// trigger
+	var mu sync.Mutex
+	var order []string
+	start := time.Now()
+	for _, trigger := range []string{"a", "b"} {
+		trigger := trigger
+		sent := time.Now()
+		calls := 0
+		r.enqueue(trigger, func() (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			order = append(order, trigger)
+			if calls == 1 {
+				require.GreaterOrEqual(t, time.Since(sent), 10*time.Millisecond)
+			} else {
+				require.GreaterOrEqual(t, time.Since(sent), 30*time.Millisecond)
+			}
+			return "", nil
+		})
+		time.Sleep(5 * time.Millisecond)
+	}
+	r.wait()
+
+	require.GreaterOrEqual(t, time.Since(start), 35*time.Millisecond)
+	sort.Strings(order)
+	require.Equal(t, []string{"a", "a", "b", "b"}, order)
+	for _, q := range r.queues {
+		require.Equal(t, 0, len(q))
+	}
+}
+
+func TestHandshakeTracker(t *testing.T) {
+	h := &handshakeTracker{
+		timeout: 50 * time.Millisecond,
+		pending: make(map[string]chan uint32),
+	}
+
+	synAck := func(sport, dport layers.TCPPort, isn uint32) gopacket.Packet {
+		ipLayer := testIPv4Layer()
+		ipLayer.SrcIP, ipLayer.DstIP = ipLayer.DstIP, ipLayer.SrcIP
+		tcpLayer := &layers.TCP{SrcPort: sport, DstPort: dport, Seq: isn, SYN: true, ACK: true}
+		tcpLayer.SetNetworkLayerForChecksum(ipLayer)
+
+		buf := gopacket.NewSerializeBuffer()
+		options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		err := gopacket.SerializeLayers(buf, options, ipLayer, tcpLayer)
+		require.Nil(t, err)
+		return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	}
+
+	local := net.ParseIP("192.168.0.1")
+	remote := net.ParseIP("192.168.0.2")
+	key := h.expect(local, 4321, remote, 443)
+
+	// syn-acks for other connections are ignored
+	h.handlePacket(synAck(443, 1234, 1))
+	h.handlePacket(synAck(443, 4321, 0xdeadbeef))
+	h.handlePacket(synAck(443, 4321, 2))
+
+	isn, err := h.wait(key)
+	require.Nil(t, err)
+	require.Equal(t, uint32(0xdeadbeef), isn)
+	require.Equal(t, 0, len(h.pending))
+
+	key = h.expect(local, 4321, remote, 443)
+	_, err = h.wait(key)
+	require.NotNil(t, err)
+	require.Equal(t, 0, len(h.pending))
+
+	// scheduled teardowns are waited on
+	var sent int32
+	for i := 0; i < 3; i++ {
+		h.teardown(func() { atomic.AddInt32(&sent, 1) })
+	}
+	h.waitTeardowns()
+	require.Equal(t, int32(3), atomic.LoadInt32(&sent))
+
+	var none *handshakeTracker
+	none.waitTeardowns()
+}
+
+func TestTCPTiming(t *testing.T) {
+	s := &tcpSender{sendSynAndAck: true, synDelay: 2 * time.Millisecond}
+	require.Equal(t, "syn-ack syn-ack:2ms ack-data:0s dup:none", s.timing())
+
+	s.ackDelay = time.Second
+	s.dupDelay = 30 * time.Second
+	require.Equal(t, "syn-ack syn-ack:2ms ack-data:1s dup:30s", s.timing())
+
+	s.synOnly = true
+	s.synDelay = 5 * time.Second
+	require.Equal(t, "syn-only syn-data:5s dup:30s", s.timing())
+
+	s = &tcpSender{}
+	require.Equal(t, "data-only dup:none", s.timing())
+
+	s.handshake = &handshakeTracker{}
+	require.Equal(t, "stateful ack-data:0s dup:none", s.timing())
+}
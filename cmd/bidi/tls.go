@@ -1,10 +1,8 @@
 package main
 
 import (
-	"encoding/hex"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"path/filepath"
 	"sync"
@@ -20,6 +18,16 @@ type tlsProber struct {
 
 	dkt *KeyTable
 
+	// fingerprint, if set, is the client profile ClientHello sent instead of
+	// the built in TLS 1.2 ClientHello.
+	fingerprint *helloTemplate
+
+	// sni selects how the tested domain appears in the ClientHello
+	sni sniVariant
+
+	// records, if set, splits the ClientHello across multiple TLS records
+	records *tlsRecordSplitter
+
 	outDir      string
 	CaptureICMP bool
 }
@@ -28,33 +36,51 @@ func (p *tlsProber) registerFlags() {
 }
 
 func (p *tlsProber) sendProbe(ip net.IP, name string, verbose bool) error {
+	laddr, addr, err := p.sendTrigger(ip, name, verbose)
+	if err != nil {
+		return err
+	}
+	return p.sender.sendResidual(laddr, addr, name, p.buildPayload, verbose)
+}
+
+// sendTrigger sends the probe without scheduling residual control probes.
+func (p *tlsProber) sendTrigger(ip net.IP, name string, verbose bool) (string, string, error) {
 
 	out, err := p.buildPayload(name)
 	if err != nil {
-		return fmt.Errorf("failed to build tls payload: %s", err)
+		return "", "", fmt.Errorf("failed to build tls payload: %s", err)
 	}
 
 	sport, _ := p.dkt.get(name)
 
 	addr := net.JoinHostPort(ip.String(), "443")
-	seqAck, sport, err := p.sender.sendTCP(addr, sport.(int), name, out, verbose)
-	if err == nil && verbose {
-		log.Printf("Sent :%d -> %s %s %s\n", sport, addr, name, seqAck)
+	seqAck, laddr, err := p.sender.sendTCP(addr, sport.(int), p.sni.hostName(name), out, verbose)
+	if err != nil {
+		return "", "", err
+	} else if verbose {
+		log.Printf("Sent %s -> %s %s sni:%s %s %s\n", laddr, addr, name, p.sni, seqAck, p.sender.timing())
 	}
 
-	return err
+	return laddr, addr, nil
 }
 
 // buildPayload builds a tls payload
-//
-// As demonstrated by the GeneratePayloads perf benchmark lots (~30%) of tls
-// payload build time is spent on hex.Decode which is avoidable. However, for
-// now generating payload is really fast anyways and hex is a convenient format
-// in which to interact with the payload. It might make sense to do hex.Decode
-// calls as some sort of init if speed matters in the future. Or move to using
-// slice init with bytes. But for now it doesn't matter.
 func (p *tlsProber) buildPayload(name string) ([]byte, error) {
-	return buildTLS1_2(name)
+	var hello []byte
+	var err error
+	if p.fingerprint != nil {
+		hello, err = p.fingerprint.build(name)
+	} else {
+		hello, err = buildTLS1_2(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	hello, err = p.sni.apply(hello, name, p.fingerprint.padded())
+	if err != nil {
+		return nil, err
+	}
+	return p.records.split(hello, p.sni.hostName(name))
 }
 
 func (p *tlsProber) handlePcap(iface string, exit chan struct{}, wg *sync.WaitGroup) {
@@ -101,111 +127,151 @@ func (p *tlsProber) handlePacket(packet gopacket.Packet) {
 	}
 }
 
-func buildTLS1_2(name string) ([]byte, error) {
-	// Record headder
-	var rh = "160301"
+// tls12CipherSuites are the cipher suites offered by the built in TLS 1.2
+// ClientHellos.
+var tls12CipherSuites = []uint16{
+	0xc02b, 0xc02f, 0xcca9, 0xcca8, 0xc02c, 0xc030, 0xc00a,
+	0xc009, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+}
 
-	// dynamic - bytes of handshake to follow
-	var packetLen = fmt.Sprintf("%04x", len(name)+0xc8)
+// tls13CipherSuites are the cipher suites offered by the built in TLS 1.3
+// ClientHellos, including the renegotiation SCSV.
+var tls13CipherSuites = []uint16{0x1302, 0x1303, 0x1301, 0x00ff}
 
-	// Handshake header and client version
-	var hh = "01" + fmt.Sprintf("%06x", len(name)+0xc4) + "0303"
+var tlsSupportedGroups = []uint16{
+	groupX25519, 0x0017, 0x001e, 0x0019, 0x0018,
+	0x0100, 0x0101, 0x0102, 0x0103, 0x0104,
+}
 
-	// dynamic - client Rand (32 generated bytes)
-	buf := make([]byte, 32)
-	n, err := rand.Read(buf)
-	if err != nil || n != 32 {
-		return nil, fmt.Errorf("failed rand read: %s", err)
-	}
-	// var clientRandom = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
-	var clientRandom = hex.EncodeToString(buf)
+var tlsSignatureAlgorithms = []uint16{
+	0x0403, 0x0503, 0x0603, 0x0807, 0x0808, 0x0809, 0x080a,
+	0x080b, 0x0804, 0x0805, 0x0806, 0x0401, 0x0501, 0x0601,
+}
 
-	// dynamic - session ID (33 bytes 32 generated)
-	n, err = rand.Read(buf)
-	if err != nil || n != 32 {
-		return nil, fmt.Errorf("failed rand read: %s", err)
+func buildTLS1_2(name string) ([]byte, error) {
+	h, err := newTLS1_2Hello(name)
+	if err != nil {
+		return nil, err
 	}
-	// var sessionID = "20e0e1e2e3e4e5e6e7e8e9eaebecedeeeff0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"
-	var sessionID = "20" + hex.EncodeToString(buf)
-
-	// Ciphersuites & Compression methods
-	var csAndCM = "001cc02bc02fcca9cca8c02cc030c00ac009c013c014009c009d002f00350100"
-
-	// dynamic - Extensions lenggth (00a3)
-	var extensionsLen = fmt.Sprintf("%04x", len(name)+0x5f)
-
-	var extSNIID = "0000"
-	// dynamic - Extension lenggth (0018)
-	var extSNIDataLen = fmt.Sprintf("%04x", len(name)+5)
-	// dynamic - Extension lenggth (0016)
-	var extSNIEntryLen = fmt.Sprintf("%04x", len(name)+3)
-	var extSNIEntryType = "00"
-	// dynamic - Extension lenggth (0013)
-	var hostnameLen = fmt.Sprintf("%04x", len(name))
-	var hostname = hex.EncodeToString([]byte(name))
+	return h.marshal()
+}
 
-	var otherExtensions = "000b000403000102000a00160014001d0017001e0019001801000101010201030104002300000016000000170000000d001e001c040305030603080708080809080a080b080408050806040105010601002d00020101"
+// newTLS1_2Hello returns the built in TLS 1.2 ClientHello with a random client
+// random and session ID.
+func newTLS1_2Hello(name string) (*clientHello, error) {
+	random, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	sessionID, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
 
-	fulldata := rh + packetLen + hh + clientRandom + sessionID + csAndCM + extensionsLen + extSNIID + extSNIDataLen + extSNIEntryLen + extSNIEntryType + hostnameLen + hostname + otherExtensions
-	return hex.DecodeString(fulldata)
+	return &clientHello{
+		recordVersion:      tlsVersion10,
+		version:            tlsVersion12,
+		random:             random,
+		sessionID:          sessionID,
+		cipherSuites:       tls12CipherSuites,
+		compressionMethods: []uint8{0},
+		extensions: []tlsExtension{
+			serverNameExtension(name),
+			pointFormatsExtension(0, 1, 2),
+			supportedGroupsExtension(tlsSupportedGroups...),
+			emptyExtension(extSessionTicket),
+			emptyExtension(extEncryptThenMAC),
+			emptyExtension(extExtendedMasterSecret),
+			signatureAlgorithmsExtension(tlsSignatureAlgorithms...),
+			pskModesExtension(1),
+		},
+	}, nil
 }
 
 func buildTLS1_3(name string) ([]byte, error) {
-	// var fulldata = "16030100f8010000f40303000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20e0e1e2e3e4e5e6e7e8e9eaebecedeeeff0f1f2f3f4f5f6f7f8f9fafbfcfdfeff000813021303130100ff010000a30000001800160000136578616d706c652e756c666865696d2e6e6574000b000403000102000a00160014001d0017001e0019001801000101010201030104002300000016000000170000000d001e001c040305030603080708080809080a080b080408050806040105010601002b0003020304002d00020101003300260024001d0020358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254"
-
-	// Record headder
-	var rh = "160301"
-
-	// dynamic - bytes of handshake to follow
-	var packetLen = fmt.Sprintf("%04x", len(name)+0xe5)
-
-	// Handshake header and client version
-	var hh = "01" + fmt.Sprintf("%06x", len(name)+0xe1) + "0303"
-
-	// dynamic - client Rand (32 generated bytes)
-	buf := make([]byte, 32)
-	n, err := rand.Read(buf)
-	if err != nil || n != 32 {
-		return nil, fmt.Errorf("failed rand read: %s", err)
+	h, err := newTLS1_3Hello(name)
+	if err != nil {
+		return nil, err
 	}
-	// var clientRandom = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
-	var clientRandom = hex.EncodeToString(buf)
+	return h.marshal()
+}
 
-	// dynamic - session ID (33 bytes 32 generated)
-	n, err = rand.Read(buf)
-	if err != nil || n != 32 {
-		return nil, fmt.Errorf("failed rand read: %s", err)
+// newTLS1_3Hello returns the built in TLS 1.3 ClientHello with a random client
+// random, session ID, and X25519 key share.
+func newTLS1_3Hello(name string) (*clientHello, error) {
+	random, err := randomBytes(32)
+	if err != nil {
+		return nil, err
 	}
-	// var sessionID = "20e0e1e2e3e4e5e6e7e8e9eaebecedeeeff0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"
-	var sessionID = "20" + hex.EncodeToString(buf)
-
-	// Ciphersuites & Compression methods
-	var csAndCM = "000813021303130100ff0100"
-
-	// dynamic - Extensions lenggth (00a3)
-	var extensionsLen = fmt.Sprintf("%04x", len(name)+0x90)
-
-	var extSNIID = "0000"
-	// dynamic - Extension lenggth (0018)
-	var extSNIDataLen = fmt.Sprintf("%04x", len(name)+5)
-	// dynamic - Extension lenggth (0016)
-	var extSNIEntryLen = fmt.Sprintf("%04x", len(name)+3)
-	var extSNIEntryType = "00"
-	// dynamic - Extension lenggth (0013)
-	var hostnameLen = fmt.Sprintf("%04x", len(name))
-	var hostname = hex.EncodeToString([]byte(name))
+	sessionID, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+	return tls13Hello(name, random, sessionID, pub), nil
+}
 
-	// dynamic(random) - Client KeyShare extension public key
-	buf = make([]byte, 32)
-	n, err = rand.Read(buf)
-	if err != nil || n != 32 {
-		return nil, fmt.Errorf("failed rand read: %s", err)
+// tls13Hello returns the built in TLS 1.3 ClientHello with the given client
+// random, session ID, and X25519 public key.
+func tls13Hello(name string, random, sessionID, pub []byte) *clientHello {
+	return &clientHello{
+		recordVersion:      tlsVersion10,
+		version:            tlsVersion12,
+		random:             random,
+		sessionID:          sessionID,
+		cipherSuites:       tls13CipherSuites,
+		compressionMethods: []uint8{0},
+		extensions: []tlsExtension{
+			serverNameExtension(name),
+			keyShareExtension(keyShare{groupX25519, pub}),
+			pointFormatsExtension(0, 1, 2),
+			supportedGroupsExtension(tlsSupportedGroups...),
+			emptyExtension(extSessionTicket),
+			emptyExtension(extEncryptThenMAC),
+			emptyExtension(extExtendedMasterSecret),
+			signatureAlgorithmsExtension(tlsSignatureAlgorithms...),
+			supportedVersionsExtension(tlsVersion13),
+			pskModesExtension(1),
+		},
 	}
-	var extKeySharePubkey = hex.EncodeToString(buf)
-	var extKeyShare = "003300260024001d0020" + extKeySharePubkey
+}
 
-	var otherExtensions = extKeyShare + "000b000403000102000a00160014001d0017001e0019001801000101010201030104002300000016000000170000000d001e001c040305030603080708080809080a080b080408050806040105010601002b0003020304002d00020101"
+// withALPN returns a copy of the ClientHello record hello with an ALPN
+// extension offering protos, replacing any ALPN extension already present. If
+// pad is set the BoringSSL style padding is recomputed for the new length.
+func withALPN(hello []byte, protos []string, pad bool) ([]byte, error) {
+	h, err := parseClientHello(hello)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.setALPN(protos); err != nil {
+		return nil, err
+	}
+	if pad {
+		if err := h.padBoring(); err != nil {
+			return nil, err
+		}
+	}
+	return h.marshal()
+}
 
-	fulldata := rh + packetLen + hh + clientRandom + sessionID + csAndCM + extensionsLen + extSNIID + extSNIDataLen + extSNIEntryLen + extSNIEntryType + hostnameLen + hostname + otherExtensions
-	return hex.DecodeString(fulldata)
+// withExtension returns a copy of the ClientHello record hello with the
+// extension ext replacing any extension of the same type already present, or
+// appended to the extensions if there is none. If pad is set the BoringSSL
+// style padding is recomputed for the new length.
+func withExtension(hello []byte, ext tlsExtension, pad bool) ([]byte, error) {
+	h, err := parseClientHello(hello)
+	if err != nil {
+		return nil, err
+	}
+	h.setExtension(ext)
+	if pad {
+		if err := h.padBoring(); err != nil {
+			return nil, err
+		}
+	}
+	return h.marshal()
 }
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	tlsRecordTypeHandshake = 0x16
+	tlsTypeClientHello     = 0x01
+
+	tlsVersion10  = 0x0301
+	tlsVersion12  = 0x0303
+	tlsVersion13  = 0x0304
+	dtlsVersion10 = 0xfeff
+	dtlsVersion12 = 0xfefd
+	dtlsVersion13 = 0xfefc
+)
+
+// TLS extension types
+const (
+	extServerName           = 0x0000
+	extSupportedGroups      = 0x000a
+	extECPointFormats       = 0x000b
+	extSignatureAlgorithms  = 0x000d
+	extUseSRTP              = 0x000e
+	extALPN                 = 0x0010
+	extPadding              = 0x0015
+	extEncryptThenMAC       = 0x0016
+	extExtendedMasterSecret = 0x0017
+	extSessionTicket        = 0x0023
+	extSupportedVersions    = 0x002b
+	extPSKModes             = 0x002d
+	extKeyShare             = 0x0033
+	extESNI                 = 0xffce
+	extECH                  = 0xfe0d
+	extRenegotiationInfo    = 0xff01
+)
+
+// named groups
+const (
+	groupX25519 = 0x001d
+)
+
+// tlsExtension is a ClientHello extension. data does not include the type
+// and length.
+type tlsExtension struct {
+	typ  uint16
+	data []byte
+}
+
+type keyShare struct {
+	group uint16
+	data  []byte
+}
+
+// clientHello is a TLS or DTLS ClientHello that marshals to a single
+// handshake record. It is built by the probers with the extension
+// constructors below, and can be mutated per probe (SNI, ALPN, key shares,
+// padding) before marshaling.
+type clientHello struct {
+	// recordVersion is the legacy version in the record header
+	recordVersion uint16
+	// version is the legacy_version of the ClientHello
+	version uint16
+	// dtls adds the DTLS record epoch and sequence number, handshake
+	// fragment fields, and cookie.
+	dtls bool
+
+	random             []byte
+	sessionID          []byte
+	cookie             []byte
+	cipherSuites       []uint16
+	compressionMethods []uint8
+	extensions         []tlsExtension
+}
+
+// extension returns the index of the extension of type typ or -1.
+func (h *clientHello) extension(typ uint16) int {
+	for i, ext := range h.extensions {
+		if ext.typ == typ {
+			return i
+		}
+	}
+	return -1
+}
+
+// setExtension replaces the extension of the same type in place, or appends
+// ext if there is none.
+func (h *clientHello) setExtension(ext tlsExtension) {
+	if i := h.extension(ext.typ); i >= 0 {
+		h.extensions[i] = ext
+		return
+	}
+	h.extensions = append(h.extensions, ext)
+}
+
+// insertExtension inserts ext before the extension at index i.
+func (h *clientHello) insertExtension(i int, ext tlsExtension) {
+	h.extensions = append(h.extensions, tlsExtension{})
+	copy(h.extensions[i+1:], h.extensions[i:])
+	h.extensions[i] = ext
+}
+
+func (h *clientHello) removeExtension(typ uint16) {
+	if i := h.extension(typ); i >= 0 {
+		h.extensions = append(h.extensions[:i], h.extensions[i+1:]...)
+	}
+}
+
+// setServerName sets the SNI, inserting the server_name extension first if
+// there is none.
+func (h *clientHello) setServerName(name string) {
+	ext := serverNameExtension(name)
+	if i := h.extension(extServerName); i >= 0 {
+		h.extensions[i] = ext
+		return
+	}
+	h.insertExtension(0, ext)
+}
+
+// setALPN sets the ALPN protocols offered, removing the extension if protos
+// is empty.
+func (h *clientHello) setALPN(protos []string) error {
+	if len(protos) == 0 {
+		h.removeExtension(extALPN)
+		return nil
+	}
+
+	ext, err := alpnExtension(protos)
+	if err != nil {
+		return err
+	}
+	h.setExtension(ext)
+	return nil
+}
+
+// randomizeKeyShares replaces the key exchange data of each key share with
+// random bytes of the same length, skipping GREASE groups.
+func (h *clientHello) randomizeKeyShares() error {
+	i := h.extension(extKeyShare)
+	if i < 0 {
+		return nil
+	}
+
+	shares, err := parseKeyShares(h.extensions[i].data)
+	if err != nil {
+		return err
+	}
+	for _, s := range shares {
+		if isGREASE(s.group) {
+			continue
+		}
+		if n, err := rand.Read(s.data); err != nil || n != len(s.data) {
+			return fmt.Errorf("failed rand read: %s", err)
+		}
+	}
+	h.extensions[i] = keyShareExtension(shares...)
+	return nil
+}
+
+// randomizeECH replaces the config id, enc, and payload of an outer ECH
+// extension, as sent for GREASE, with random bytes of the same length.
+func (h *clientHello) randomizeECH() error {
+	i := h.extension(extECH)
+	if i < 0 {
+		return nil
+	}
+
+	s := cryptobyte.String(h.extensions[i].data)
+	var echType, configID uint8
+	var suite []byte
+	var enc, payload cryptobyte.String
+	if !s.ReadUint8(&echType) || echType != 0 {
+		// an inner ECH extension has nothing to randomize
+		return nil
+	}
+	if !s.ReadBytes(&suite, 4) || !s.ReadUint8(&configID) ||
+		!s.ReadUint16LengthPrefixed(&enc) || !s.ReadUint16LengthPrefixed(&payload) || !s.Empty() {
+		return fmt.Errorf("malformed ech extension")
+	}
+
+	random, err := randomBytes(1 + len(enc) + len(payload))
+	if err != nil {
+		return err
+	}
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(echType)
+	b.AddBytes(suite)
+	b.AddUint8(random[0])
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(random[1 : 1+len(enc)])
+	})
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(random[1+len(enc):])
+	})
+	h.extensions[i] = tlsExtension{extECH, b.BytesOrPanic()}
+	return nil
+}
+
+// padBoring adds (or removes) the padding extension the way BoringSSL does,
+// padding ClientHellos between 256 and 511 bytes to 512 bytes.
+func (h *clientHello) padBoring() error {
+	h.removeExtension(extPadding)
+
+	b, err := h.marshalHandshake()
+	if err != nil {
+		return err
+	}
+	if n, ok := boringPaddingLen(len(b)); ok {
+		h.extensions = append(h.extensions, paddingExtension(n))
+	}
+	return nil
+}
+
+func (h *clientHello) addBody(b *cryptobyte.Builder) {
+	b.AddUint16(h.version)
+	b.AddBytes(h.random)
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(h.sessionID)
+	})
+	if h.dtls {
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(h.cookie)
+		})
+	}
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, cs := range h.cipherSuites {
+			b.AddUint16(cs)
+		}
+	})
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(h.compressionMethods)
+	})
+	if len(h.extensions) == 0 {
+		return
+	}
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, ext := range h.extensions {
+			b.AddUint16(ext.typ)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(ext.data)
+			})
+		}
+	})
+}
+
+// marshalHandshake returns the TLS ClientHello handshake message (without a
+// record header) as carried in QUIC CRYPTO frames.
+func (h *clientHello) marshalHandshake() ([]byte, error) {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(tlsTypeClientHello)
+	b.AddUint24LengthPrefixed(h.addBody)
+	return b.Bytes()
+}
+
+// marshal returns the ClientHello in a handshake record.
+func (h *clientHello) marshal() ([]byte, error) {
+	body := cryptobyte.NewBuilder(nil)
+	h.addBody(body)
+	bodyBytes, err := body.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(tlsRecordTypeHandshake)
+	b.AddUint16(h.recordVersion)
+	if h.dtls {
+		b.AddUint16(0) // epoch
+		b.AddUint48(0) // sequence number
+	}
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(tlsTypeClientHello)
+		b.AddUint24(uint32(len(bodyBytes)))
+		if h.dtls {
+			b.AddUint16(0)                      // message sequence
+			b.AddUint24(0)                      // fragment offset
+			b.AddUint24(uint32(len(bodyBytes))) // fragment length
+		}
+		b.AddBytes(bodyBytes)
+	})
+	return b.Bytes()
+}
+
+var errBadClientHello = errors.New("malformed client hello")
+
+// parseClientHello parses a ClientHello handshake record as produced by
+// marshal (a single unfragmented record).
+func parseClientHello(record []byte) (*clientHello, error) {
+	h := &clientHello{}
+	s := cryptobyte.String(record)
+
+	var typ uint8
+	var fragment cryptobyte.String
+	if !s.ReadUint8(&typ) || typ != tlsRecordTypeHandshake || !s.ReadUint16(&h.recordVersion) {
+		return nil, errBadClientHello
+	}
+	h.dtls = h.recordVersion>>8 == 0xfe
+	if h.dtls && !s.Skip(8) {
+		return nil, errBadClientHello
+	}
+	if !s.ReadUint16LengthPrefixed(&fragment) || !s.Empty() {
+		return nil, errBadClientHello
+	}
+
+	var body cryptobyte.String
+	var length uint32
+	if !fragment.ReadUint8(&typ) || typ != tlsTypeClientHello || !fragment.ReadUint24(&length) {
+		return nil, errBadClientHello
+	}
+	if h.dtls && !fragment.Skip(8) {
+		return nil, errBadClientHello
+	}
+	if !fragment.ReadBytes((*[]byte)(&body), int(length)) || !fragment.Empty() {
+		return nil, errBadClientHello
+	}
+
+	var sessionID, cookie, cipherSuites, compressionMethods, extensions cryptobyte.String
+	if !body.ReadUint16(&h.version) ||
+		!body.ReadBytes(&h.random, 32) ||
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		(h.dtls && !body.ReadUint8LengthPrefixed(&cookie)) ||
+		!body.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!body.ReadUint8LengthPrefixed(&compressionMethods) {
+		return nil, errBadClientHello
+	}
+	h.sessionID = sessionID
+	h.cookie = cookie
+	h.compressionMethods = compressionMethods
+
+	for !cipherSuites.Empty() {
+		var cs uint16
+		if !cipherSuites.ReadUint16(&cs) {
+			return nil, errBadClientHello
+		}
+		h.cipherSuites = append(h.cipherSuites, cs)
+	}
+
+	if body.Empty() {
+		return h, nil
+	}
+	if !body.ReadUint16LengthPrefixed(&extensions) || !body.Empty() {
+		return nil, errBadClientHello
+	}
+	for !extensions.Empty() {
+		var ext tlsExtension
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&ext.typ) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, errBadClientHello
+		}
+		ext.data = data
+		h.extensions = append(h.extensions, ext)
+	}
+
+	return h, nil
+}
+
+// serverNameExtension returns a server_name extension with a host_name entry
+// for each of names.
+func serverNameExtension(names ...string) tlsExtension {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, name := range names {
+			b.AddUint8(0) // host_name
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes([]byte(name))
+			})
+		}
+	})
+	return tlsExtension{extServerName, b.BytesOrPanic()}
+}
+
+func alpnExtension(protos []string) (tlsExtension, error) {
+	for _, proto := range protos {
+		if len(proto) == 0 || len(proto) > 255 {
+			return tlsExtension{}, fmt.Errorf("bad alpn protocol \"%s\"", proto)
+		}
+	}
+
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, proto := range protos {
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes([]byte(proto))
+			})
+		}
+	})
+	return tlsExtension{extALPN, b.BytesOrPanic()}, nil
+}
+
+func supportedGroupsExtension(groups ...uint16) tlsExtension {
+	return tlsExtension{extSupportedGroups, uint16List(groups)}
+}
+
+func signatureAlgorithmsExtension(algs ...uint16) tlsExtension {
+	return tlsExtension{extSignatureAlgorithms, uint16List(algs)}
+}
+
+func pointFormatsExtension(formats ...uint8) tlsExtension {
+	return tlsExtension{extECPointFormats, uint8List(formats)}
+}
+
+func pskModesExtension(modes ...uint8) tlsExtension {
+	return tlsExtension{extPSKModes, uint8List(modes)}
+}
+
+func supportedVersionsExtension(versions ...uint16) tlsExtension {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, v := range versions {
+			b.AddUint16(v)
+		}
+	})
+	return tlsExtension{extSupportedVersions, b.BytesOrPanic()}
+}
+
+func keyShareExtension(shares ...keyShare) tlsExtension {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, s := range shares {
+			b.AddUint16(s.group)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(s.data)
+			})
+		}
+	})
+	return tlsExtension{extKeyShare, b.BytesOrPanic()}
+}
+
+func parseKeyShares(data []byte) ([]keyShare, error) {
+	s := cryptobyte.String(data)
+	var list cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&list) || !s.Empty() {
+		return nil, fmt.Errorf("malformed key_share extension")
+	}
+
+	var shares []keyShare
+	for !list.Empty() {
+		var share keyShare
+		var keyExchange cryptobyte.String
+		if !list.ReadUint16(&share.group) || !list.ReadUint16LengthPrefixed(&keyExchange) {
+			return nil, fmt.Errorf("malformed key_share extension")
+		}
+		share.data = append([]byte{}, keyExchange...)
+		shares = append(shares, share)
+	}
+	return shares, nil
+}
+
+// useSRTPExtension returns a use_srtp extension (RFC 5764) offering profiles
+// with the given MKI.
+func useSRTPExtension(profiles []uint16, mki []byte) tlsExtension {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddBytes(uint16List(profiles))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(mki)
+	})
+	return tlsExtension{extUseSRTP, b.BytesOrPanic()}
+}
+
+// renegotiationInfoExtension returns an empty renegotiation_info extension
+// for an initial handshake.
+func renegotiationInfoExtension() tlsExtension {
+	return tlsExtension{extRenegotiationInfo, []byte{0x00}}
+}
+
+func paddingExtension(n int) tlsExtension {
+	return tlsExtension{extPadding, make([]byte, n)}
+}
+
+// emptyExtension returns an extension with no data (e.g. session_ticket,
+// encrypt_then_mac, extended_master_secret).
+func emptyExtension(typ uint16) tlsExtension {
+	return tlsExtension{typ, nil}
+}
+
+func uint16List(vals []uint16) []byte {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, v := range vals {
+			b.AddUint16(v)
+		}
+	})
+	return b.BytesOrPanic()
+}
+
+func uint8List(vals []uint8) []byte {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(vals)
+	})
+	return b.BytesOrPanic()
+}
+
+// isGREASE reports whether v is a GREASE value (RFC 8701).
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// randomBytes returns n bytes from math/rand so that probes are reproducible
+// with -seed.
+func randomBytes(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if m, err := rand.Read(buf); err != nil || m != n {
+		return nil, fmt.Errorf("failed rand read: %s", err)
+	}
+	return buf, nil
+}
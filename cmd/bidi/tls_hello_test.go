@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientHelloRoundTrip(t *testing.T) {
+	name := "example.ulfheim.net"
+	builders := map[string]func(string) ([]byte, error){
+		"tls1.2":  buildTLS1_2,
+		"tls1.3":  buildTLS1_3,
+		"ech":     func(n string) ([]byte, error) { return buildECH1_3(n, true, false) },
+		"esni":    func(n string) ([]byte, error) { return buildECH1_3(n, false, true) },
+		"dtls1.2": func(n string) ([]byte, error) { return buildDTLS1_2(n, true) },
+		"dtls1.3": func(n string) ([]byte, error) { return buildDTLS1_3(n, true) },
+		"chrome": func(n string) ([]byte, error) {
+			tmpl, err := loadHelloTemplate("chrome")
+			if err != nil {
+				return nil, err
+			}
+			return tmpl.build(n)
+		},
+	}
+
+	for label, build := range builders {
+		hello, err := build(name)
+		require.Nil(t, err, label)
+
+		h, err := parseClientHello(hello)
+		require.Nil(t, err, label)
+		require.Equal(t, 32, len(h.random), label)
+		require.Equal(t, strings.HasPrefix(label, "dtls"), h.dtls, label)
+
+		i := h.extension(extServerName)
+		require.GreaterOrEqual(t, i, 0, label)
+		require.Equal(t, serverNameExtension(name), h.extensions[i], label)
+
+		out, err := h.marshal()
+		require.Nil(t, err, label)
+		require.Equal(t, hello, out, label)
+	}
+
+	// DTLS without SNI
+	hello, err := buildDTLS1_2(name, false)
+	require.Nil(t, err)
+	h, err := parseClientHello(hello)
+	require.Nil(t, err)
+	require.Equal(t, -1, h.extension(extServerName))
+
+	for _, bad := range [][]byte{nil, hello[:20], hello[:len(hello)-1], append(hello, 0x00)} {
+		_, err = parseClientHello(bad)
+		require.NotNil(t, err)
+	}
+}
+
+func TestClientHelloMutation(t *testing.T) {
+	h, err := newTLS1_3Hello("example.com")
+	require.Nil(t, err)
+	n := len(h.extensions)
+
+	h.setServerName("example.org")
+	require.Equal(t, n, len(h.extensions))
+	require.Equal(t, serverNameExtension("example.org"), h.extensions[0])
+
+	h.removeExtension(extServerName)
+	require.Equal(t, -1, h.extension(extServerName))
+	h.setServerName("example.net")
+	require.Equal(t, 0, h.extension(extServerName))
+
+	require.Nil(t, h.setALPN([]string{"h2", "http/1.1"}))
+	require.Equal(t, n, h.extension(extALPN))
+	require.Equal(t, []byte("\x00\x0c\x02h2\x08http/1.1"), h.extensions[n].data)
+	require.Nil(t, h.setALPN([]string{"dot"}))
+	require.Equal(t, n+1, len(h.extensions))
+	require.NotNil(t, h.setALPN([]string{strings.Repeat("a", 256)}))
+	require.Nil(t, h.setALPN(nil))
+	require.Equal(t, -1, h.extension(extALPN))
+
+	before := append([]byte{}, h.extensions[h.extension(extKeyShare)].data...)
+	require.Nil(t, h.randomizeKeyShares())
+	after := h.extensions[h.extension(extKeyShare)].data
+	require.Equal(t, len(before), len(after))
+	require.Equal(t, before[:6], after[:6])
+	require.NotEqual(t, before[6:], after[6:])
+
+	// pad into the 256-511 byte range BoringSSL pads to 512 bytes
+	h.setExtension(tlsExtension{0xfe00, make([]byte, 100)})
+	require.Nil(t, h.padBoring())
+	hs, err := h.marshalHandshake()
+	require.Nil(t, err)
+	require.Equal(t, 512, len(hs))
+
+	record, err := h.marshal()
+	require.Nil(t, err)
+	require.Equal(t, hs, record[5:])
+}
+
+// TestClientHelloStdlib checks that the built ClientHellos are accepted by
+// the crypto/tls ClientHello parser.
+func TestClientHelloStdlib(t *testing.T) {
+	name := "example.com"
+
+	h12, err := newTLS1_2Hello(name)
+	require.Nil(t, err)
+	require.Nil(t, h12.setALPN([]string{"dot"}))
+
+	h13, err := newTLS1_3Hello(name)
+	require.Nil(t, err)
+	require.Nil(t, h13.setALPN([]string{"h2", "http/1.1"}))
+	require.Nil(t, h13.padBoring())
+
+	for _, tc := range []struct {
+		h        *clientHello
+		alpn     []string
+		versions []uint16
+	}{
+		// without supported_versions the legacy version is the maximum
+		{h12, []string{"dot"}, []uint16{tls.VersionTLS12, tls.VersionTLS11, tls.VersionTLS10}},
+		{h13, []string{"h2", "http/1.1"}, []uint16{tls.VersionTLS13}},
+	} {
+		hello, err := tc.h.marshal()
+		require.Nil(t, err)
+
+		info := stdlibClientHello(t, hello)
+		require.Equal(t, name, info.ServerName)
+		require.Equal(t, tc.alpn, info.SupportedProtos)
+		require.Equal(t, tc.versions, info.SupportedVersions)
+		require.Equal(t, tc.h.cipherSuites, info.CipherSuites)
+	}
+}
+
+// stdlibClientHello returns the ClientHelloInfo crypto/tls parses from hello.
+func stdlibClientHello(t *testing.T, hello []byte) *tls.ClientHelloInfo {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		client.Write(hello)
+		io.Copy(io.Discard, client)
+	}()
+
+	var info *tls.ClientHelloInfo
+	stop := errors.New("stop")
+	err := tls.Server(server, &tls.Config{
+		GetConfigForClient: func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			info = chi
+			return nil, stop
+		},
+	}).Handshake()
+	require.True(t, errors.Is(err, stop), err)
+	require.NotNil(t, info)
+	return info
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// tlsRecordSplitter splits the handshake message of a ClientHello record
+// across multiple TLS records, to test whether middle-boxes reassemble the
+// handshake before matching the SNI. The records are sent in one TCP segment
+// unless the tcp segmenter splits them (e.g. -tcp-seg records).
+//
+// Split points use the tcp segmenter modes, relative to the start of the
+// handshake message (the first byte after the record header):
+//
+//	none      - send the ClientHello in one record
+//	offset:N  - split the handshake message at byte offset N
+//	domain    - split in the middle of the probed domain (i.e. in the SNI)
+//	equal:N   - split the handshake message into N (roughly) equal records
+type tlsRecordSplitter struct {
+	seg *tcpSegmenter
+}
+
+func parseRecordSplitter(spec string) (*tlsRecordSplitter, error) {
+	seg, err := parseSegmenter(spec, "forward", 0)
+	if err != nil {
+		return nil, fmt.Errorf("tls records: %s", err)
+	}
+
+	switch seg.mode {
+	case "", "none":
+		return nil, nil
+	case "records":
+		return nil, fmt.Errorf("tls records: records is only a tcp segment mode")
+	}
+	return &tlsRecordSplitter{seg: seg}, nil
+}
+
+// split returns the single TLS record payload re-framed as multiple records
+// of the same type and version. A nil splitter returns the payload unchanged.
+func (s *tlsRecordSplitter) split(payload []byte, domain string) ([]byte, error) {
+	if s == nil {
+		return payload, nil
+	}
+
+	if len(payload) < 5 || 5+int(binary.BigEndian.Uint16(payload[3:])) != len(payload) {
+		return nil, fmt.Errorf("payload is not a single tls record")
+	}
+	msg := payload[5:]
+
+	cuts := s.seg.cuts(msg, domain)
+	out := make([]byte, 0, len(payload)+5*len(cuts))
+	start := 0
+	for _, c := range append(cuts, len(msg)) {
+		if c <= start || c > len(msg) {
+			continue
+		}
+		out = append(out, payload[:3]...)
+		out = binary.BigEndian.AppendUint16(out, uint16(c-start))
+		out = append(out, msg[start:c]...)
+		start = c
+	}
+	return out, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// tlsRecords returns the records of payload checking that the lengths are
+// consistent.
+func tlsRecords(t *testing.T, payload []byte) [][]byte {
+	var records [][]byte
+	for len(payload) > 0 {
+		require.GreaterOrEqual(t, len(payload), 5)
+		n := 5 + int(binary.BigEndian.Uint16(payload[3:]))
+		require.LessOrEqual(t, n, len(payload))
+		records = append(records, payload[:n])
+		payload = payload[n:]
+	}
+	return records
+}
+
+func TestRecordSplitter(t *testing.T) {
+	name := "example.com"
+	hello, err := buildTLS1_2(name)
+	require.Nil(t, err)
+
+	s, err := parseRecordSplitter("none")
+	require.Nil(t, err)
+	require.Nil(t, s)
+	out, err := s.split(hello, name)
+	require.Nil(t, err)
+	require.Equal(t, hello, out)
+
+	for _, tc := range []struct {
+		spec    string
+		records int
+	}{
+		{"offset:1", 2},
+		{"domain", 2},
+		{"equal:4", 4},
+		{"offset:10000", 1},
+	} {
+		s, err := parseRecordSplitter(tc.spec)
+		require.Nil(t, err, tc.spec)
+
+		out, err := s.split(hello, name)
+		require.Nil(t, err, tc.spec)
+		require.Equal(t, len(hello)+5*(tc.records-1), len(out), tc.spec)
+
+		records := tlsRecords(t, out)
+		require.Equal(t, tc.records, len(records), tc.spec)
+
+		var msg []byte
+		for _, r := range records {
+			require.Equal(t, hello[:3], r[:3], tc.spec)
+			msg = append(msg, r[5:]...)
+		}
+		require.Equal(t, hello[5:], msg, tc.spec)
+	}
+
+	// the domain is split between the records
+	s, err = parseRecordSplitter("domain")
+	require.Nil(t, err)
+	out, err = s.split(hello, name)
+	require.Nil(t, err)
+	require.False(t, bytes.Contains(out, []byte(name)))
+	records := tlsRecords(t, out)
+	require.True(t, bytes.HasSuffix(records[0], []byte("examp")))
+	require.True(t, bytes.HasPrefix(records[1][5:], []byte("le.com")))
+
+	_, err = s.split(hello[:len(hello)-1], name)
+	require.NotNil(t, err)
+	_, err = s.split(append(hello, hello...), name)
+	require.NotNil(t, err)
+
+	for _, bad := range []string{"records", "equal:0", "bogus"} {
+		_, err = parseRecordSplitter(bad)
+		require.NotNil(t, err, bad)
+	}
+}
+
+func TestRecordSegments(t *testing.T) {
+	name := "example.com"
+	r, err := parseRecordSplitter("equal:3")
+	require.Nil(t, err)
+
+	p := &tlsProber{records: r, sni: sniMixedCase}
+	out, err := p.buildPayload(name)
+	require.Nil(t, err)
+	records := tlsRecords(t, out)
+	require.Equal(t, 3, len(records))
+
+	s, err := parseSegmenter("records", "forward", 0)
+	require.Nil(t, err)
+	segments := s.split(out, name)
+	require.Equal(t, len(records), len(segments))
+	for i, seg := range segments {
+		require.Equal(t, records[i], seg.data)
+	}
+	require.Equal(t, string(out), joinSegments(segments))
+
+	// the mixed case SNI is split with the domain mode
+	r, err = parseRecordSplitter("domain")
+	require.Nil(t, err)
+	pe := &echProber{records: r, sni: sniMixedCase, send1_3: true, ech: true}
+	out, err = pe.buildPayload(name)
+	require.Nil(t, err)
+	records = tlsRecords(t, out)
+	require.Equal(t, 2, len(records))
+	require.True(t, bytes.HasSuffix(records[0], []byte("ExAmP")))
+
+	// a single record is one segment
+	hello, err := buildTLS1_3(name)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(s.split(hello, name)))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"math/rand"
@@ -27,3 +28,39 @@ func TestTLSPayload(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, expected, hex.EncodeToString(payload))
 }
+
+func TestWithALPN(t *testing.T) {
+	name := "example.com"
+	hello, err := buildTLS1_2(name)
+	require.Nil(t, err)
+
+	out, err := withALPN(hello, []string{"dot"}, false)
+	require.Nil(t, err)
+	require.Equal(t, len(hello)+10, len(out))
+	require.Equal(t, hello[9:108], out[9:108])
+	require.Equal(t, "00100006000403646f74", hex.EncodeToString(out[len(hello):]))
+
+	// record, handshake, and extensions lengths are updated
+	require.Equal(t, len(out)-5, int(binary.BigEndian.Uint16(out[3:])))
+	require.Equal(t, len(out)-9, int(out[6])<<16|int(out[7])<<8|int(out[8]))
+	require.Equal(t, len(out)-110, int(binary.BigEndian.Uint16(out[108:])))
+
+	_, err = withALPN(hello, []string{""}, false)
+	require.NotNil(t, err)
+	_, err = withALPN(hello[:50], []string{"dot"}, false)
+	require.NotNil(t, err)
+}
+
+func TestDoTPayload(t *testing.T) {
+	p := &dotProber{send1_3: true, alpn: "dot,h2"}
+
+	out, err := p.buildPayload("example.com")
+	require.Nil(t, err)
+	require.Equal(t, len(out)-5, int(binary.BigEndian.Uint16(out[3:])))
+	require.Equal(t, "00100009000703646f74026832", hex.EncodeToString(out[len(out)-13:]))
+
+	p = &dotProber{}
+	out, err = p.buildPayload("example.com")
+	require.Nil(t, err)
+	require.NotContains(t, string(out), "dot")
+}
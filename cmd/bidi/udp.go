@@ -14,15 +14,29 @@ import (
 )
 
 type udpSender struct {
-	lAddr4, lAddr6 string
+	src4 *addrPool
+	src6 *addrPool
+
+	// srcPerProbe assigns source addresses round robin for each probe rather
+	// than keeping one source address per target.
+	srcPerProbe bool
 
 	//--- Raw send options ---
 	sendRaw bool
-	src4    net.IP
-	src6    net.IP
 
 	checksums bool
 
+	// fragmenter splits packets into IP fragments. nil disables IP
+	// fragmentation.
+	fragmenter *ipFragmenter
+
+	// ext6 are IPv6 extension headers inserted into every IPv6 packet.
+	ext6 []ipv6ExtHeader
+
+	// repeat retransmits each probe when in identical mode. nil sends each
+	// probe once.
+	repeat *probeRepeat
+
 	device  string
 	sockFd4 int
 	sockFd6 int
@@ -34,12 +48,12 @@ func newUDPSender(device, lAddr4, lAddr6 string, sendRaw, checksums bool) (*udpS
 		return nil, fmt.Errorf("bad device name: \"%s\"", device)
 	}
 
-	localIP4, err := getSrcIP(localIface, lAddr4, net.ParseIP("1.2.3.4"))
+	localIP4, err := newAddrPool(localIface, lAddr4+","+lAddr6, net.ParseIP("1.2.3.4"))
 	if err != nil {
 		return nil, err
 	}
 
-	localIP6, err := getSrcIP(localIface, lAddr6, net.ParseIP("2606:4700::"))
+	localIP6, err := newAddrPool(localIface, lAddr4+","+lAddr6, net.ParseIP("2606:4700::"))
 	if err != nil {
 		log.Println("failed to init IPv6 - likely not supported")
 	}
@@ -57,13 +71,11 @@ func newUDPSender(device, lAddr4, lAddr6 string, sendRaw, checksums bool) (*udpS
 	var u *udpSender
 	if sendRaw {
 		u = &udpSender{
-			lAddr4: localIP4.String(),
-			lAddr6: localIP6.String(),
+			src4: localIP4,
+			src6: localIP6,
 
 			sendRaw: sendRaw,
 			device:  device,
-			src4:    localIP4,
-			src6:    localIP6,
 
 			checksums: checksums,
 
@@ -72,8 +84,8 @@ func newUDPSender(device, lAddr4, lAddr6 string, sendRaw, checksums bool) (*udpS
 		}
 	} else {
 		u = &udpSender{
-			lAddr4:  localIP4.String(),
-			lAddr6:  localIP6.String(),
+			src4:    localIP4,
+			src6:    localIP6,
 			sendRaw: sendRaw,
 		}
 	}
@@ -90,6 +102,7 @@ func (u *udpSender) clean() {
 }
 
 // if sport is 0 (unset) then the Dial should generate a random source port.
+// Returns the local address (ip:port) that the probe was sent from.
 func (u *udpSender) sendUDP(dst string, sport int, payload []byte, verbose bool) (string, error) {
 
 	if u.sendRaw {
@@ -103,20 +116,23 @@ func (u *udpSender) sendUDP(dst string, sport int, payload []byte, verbose bool)
 		return "", fmt.Errorf("failed to parse \"ip:port\": %s - %s", dst, err)
 	}
 
-	useV4 := net.ParseIP(host).To4() != nil
+	ip := net.ParseIP(host)
+	useV4 := ip.To4() != nil
 	if useV4 {
-		if u.lAddr4 == "" {
+		if u.src4 == nil {
 			return "", fmt.Errorf("no IPv4 address available")
 		}
-		d.LocalAddr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(u.lAddr4, strconv.Itoa(sport)))
+		src := u.src4.pick(ip, u.srcPerProbe)
+		d.LocalAddr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(src.String(), strconv.Itoa(sport)))
 		if err != nil {
 			log.Println(err)
 		}
 	} else if !useV4 {
-		if u.lAddr6 == "" {
+		if u.src6 == nil {
 			return "", fmt.Errorf("no IPv6 address available")
 		}
-		d.LocalAddr, _ = net.ResolveUDPAddr("ip", net.JoinHostPort(u.lAddr6, strconv.Itoa(sport)))
+		src := u.src6.pick(ip, u.srcPerProbe)
+		d.LocalAddr, _ = net.ResolveUDPAddr("udp", net.JoinHostPort(src.String(), strconv.Itoa(sport)))
 	}
 
 	conn, err := d.Dial("udp", dst)
@@ -125,17 +141,29 @@ func (u *udpSender) sendUDP(dst string, sport int, payload []byte, verbose bool)
 	}
 	defer conn.Close()
 
-	n, err := conn.Write(payload)
+	send := func() error {
+		n, err := conn.Write(payload)
+		if err != nil {
+			return err
+		}
+		stats.incPacketPerSec()
+		stats.incBytesPerSec(n)
+		return nil
+	}
+
+	err = send()
 	if err != nil {
 		return "", err
 	}
-	stats.incPacketPerSec()
-	stats.incBytesPerSec(n)
 
-	h := conn.LocalAddr().String()
-	_, p, err := net.SplitHostPort(h)
+	if n := u.repeat.identical(); n > 0 {
+		err = retransmit(n, u.repeat.interval, send)
+		if err != nil {
+			return "", err
+		}
+	}
 
-	return p, err
+	return conn.LocalAddr().String(), nil
 }
 
 func (u *udpSender) sendUDPRaw(dst string, sport int, payload []byte, verbose bool) (string, error) {
@@ -148,10 +176,15 @@ func (u *udpSender) sendUDPRaw(dst string, sport int, payload []byte, verbose bo
 	ip := net.ParseIP(host)
 
 	var useV4 = ip.To4() != nil
+	var src net.IP
 	if useV4 && u.src4 == nil {
 		return "", fmt.Errorf("no IPv4 address available")
 	} else if !useV4 && u.src6 == nil {
 		return "", fmt.Errorf("no IPv6 address available")
+	} else if useV4 {
+		src = u.src4.pick(ip, u.srcPerProbe)
+	} else {
+		src = u.src6.pick(ip, u.srcPerProbe)
 	}
 
 	options := gopacket.SerializeOptions{
@@ -175,7 +208,7 @@ func (u *udpSender) sendUDPRaw(dst string, sport int, payload []byte, verbose bo
 	var networkLayer netLayer
 	if useV4 {
 		ipLayer4 := &layers.IPv4{
-			SrcIP:    u.src4,
+			SrcIP:    src,
 			DstIP:    ip,
 			Version:  4,
 			TTL:      64,
@@ -185,7 +218,7 @@ func (u *udpSender) sendUDPRaw(dst string, sport int, payload []byte, verbose bo
 		networkLayer = ipLayer4
 	} else {
 		ipLayer6 := &layers.IPv6{
-			SrcIP:      u.src6,
+			SrcIP:      src,
 			DstIP:      ip,
 			Version:    6,
 			HopLimit:   64,
@@ -202,6 +235,14 @@ func (u *udpSender) sendUDPRaw(dst string, sport int, payload []byte, verbose bo
 	if err != nil {
 		return "", err
 	}
+	pkt := udpPayloadBuf.Bytes()
+
+	if !useV4 && len(u.ext6) > 0 {
+		pkt, err = withIPv6ExtHeaders(pkt, u.ext6)
+		if err != nil {
+			return "", err
+		}
+	}
 	// XXX end of packet creation
 
 	// XXX send packet
@@ -221,10 +262,21 @@ func (u *udpSender) sendUDPRaw(dst string, sport int, payload []byte, verbose bo
 		}
 	}
 
-	err = sendPkt(sockFd, udpPayloadBuf.Bytes(), addr)
+	send := func() error {
+		return sendFragmented(sockFd, pkt, addr, u.fragmenter)
+	}
+
+	err = send()
 	if err != nil {
 		return "", err
 	}
 
-	return strconv.Itoa(sport), nil
+	if n := u.repeat.identical(); n > 0 {
+		err = retransmit(n, u.repeat.interval, send)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return net.JoinHostPort(src.String(), strconv.Itoa(sport)), nil
 }
@@ -2,113 +2,50 @@ package main
 
 import (
 	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
-	tls "github.com/refraction-networking/utls"
-	"net"
-)
-
-func getSpec() tls.ClientHelloSpec {
-	return tls.ClientHelloSpec{
-		CipherSuites: []uint16{
-			tls.GREASE_PLACEHOLDER,
-			tls.TLS_AES_128_GCM_SHA256,
-			tls.TLS_AES_256_GCM_SHA384,
-			tls.TLS_CHACHA20_POLY1305_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-		},
-		CompressionMethods: []byte{
-			0x00, // compressionNone
-		},
-		Extensions: []tls.TLSExtension{
-			&tls.UtlsGREASEExtension{},
-			&tls.SNIExtension{},
-			&tls.UtlsExtendedMasterSecretExtension{},
-			&tls.RenegotiationInfoExtension{Renegotiation: tls.RenegotiateOnceAsClient},
-			&tls.SupportedCurvesExtension{[]tls.CurveID{
-				tls.CurveID(tls.GREASE_PLACEHOLDER),
-				tls.X25519,
-				tls.CurveP256,
-				tls.CurveP384,
-			}},
-			&tls.SupportedPointsExtension{SupportedPoints: []byte{
-				0x00, // pointFormatUncompressed
-			}},
-			&tls.SessionTicketExtension{},
-			&tls.ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}},
-			&tls.StatusRequestExtension{},
-			&tls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []tls.SignatureScheme{
-				tls.ECDSAWithP256AndSHA256,
-				tls.PSSWithSHA256,
-				tls.PKCS1WithSHA256,
-				tls.ECDSAWithP384AndSHA384,
-				tls.PSSWithSHA384,
-				tls.PKCS1WithSHA384,
-				tls.PSSWithSHA512,
-				tls.PKCS1WithSHA512,
-			}},
-			&tls.SCTExtension{},
-			&tls.KeyShareExtension{[]tls.KeyShare{
-				{Group: tls.CurveID(tls.GREASE_PLACEHOLDER), Data: []byte{0}},
-				{Group: tls.X25519},
-			}},
-			&tls.PSKKeyExchangeModesExtension{[]uint8{
-				tls.PskModeDHE,
-			}},
-			&tls.SupportedVersionsExtension{[]uint16{
-				tls.GREASE_PLACEHOLDER,
-				tls.VersionTLS13,
-				tls.VersionTLS12,
-			}},
-			&tls.UtlsCompressCertExtension{},
-			&tls.GenericExtension{Id: 0x4469}, // WARNING: UNKNOWN EXTENSION, USE AT YOUR OWN RISK
-			&tls.UtlsGREASEExtension{},
-			&tls.UtlsPaddingExtension{GetPaddingLen: tls.BoringPaddingStyle},
-		},
-	}
+	"log"
+	"os"
 
-}
+	"gen/hello"
+)
 
 func main() {
+	profile := flag.String("profile", "chrome-legacy", fmt.Sprintf("ClientHello profile to print. One of %v", hello.Names()))
+	sni := flag.String("sni", "tlsfingerprint.io", "Server name to send")
+	templates := flag.String("templates", "", "Write templates of every profile as JSON to this file (e.g. ../bidi/fingerprints.json) instead of printing a ClientHello")
+	flag.Parse()
+
+	if *templates != "" {
+		if err := writeTemplates(*templates); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	server, client := net.Pipe()
-
-	tlsConfig := tls.Config{ServerName: "tlsfingerprint.io"}
-	uconn := tls.UClient(client, &tlsConfig, tls.HelloCustom)
-
-	clientHelloSpec := getSpec()
-	uconn.ApplyPreset(&clientHelloSpec)
-
-	/*
-		//err := uconn.BuildHandshakeState()
-		//msg, _, err := uconn.makeClientHello()
-		if err != nil {
-			fmt.Printf("Got error: %s; expected to succeed", err)
-			return
-		}*/
-	go func() {
-		uconn.Handshake()
-	}()
-
-	buf := make([]byte, 4096)
-	n, err := server.Read(buf)
+	record, _, err := hello.Generate(*profile, *sni)
 	if err != nil {
 		fmt.Printf("Got error: %v\n", err)
 		return
 	}
 
-	fmt.Printf("Read %d bytes: %s\n", n, hex.EncodeToString(buf[:n]))
-	//fmt.Printf("%s\n", hex.EncodeToString(uconn.HandshakeState.Hello.Raw))
-	//marshalledHello := msg.marshal()
+	fmt.Printf("Read %d bytes: %s\n", len(record), hex.EncodeToString(record))
+}
 
+func writeTemplates(path string) error {
+	var templates []*hello.Template
+	for _, name := range hello.Names() {
+		t, err := hello.NewTemplate(name)
+		if err != nil {
+			return err
+		}
+		templates = append(templates, t)
+	}
+
+	b, err := json.MarshalIndent(templates, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0666)
 }
@@ -0,0 +1,99 @@
+// Package hello generates browser accurate TLS ClientHello messages with
+// uTLS, and templates of them with the per connection fields marked so that
+// probes can be built from them without running uTLS.
+package hello
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Names returns the profile names in sorted order.
+func Names() []string {
+	var names []string
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Generate returns the ClientHello record (starting at the record header)
+// sent by profile for the server name sni, and whether the profile pads the
+// ClientHello (BoringSSL style) at the given index in the list of extensions
+// on the wire. padIndex is -1 if the profile does not pad.
+func Generate(profile, sni string) (record []byte, padIndex int, err error) {
+	p, ok := Profiles[profile]
+	if !ok {
+		return nil, -1, fmt.Errorf("unknown profile \"%s\"", profile)
+	}
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	uconn := tls.UClient(client, &tls.Config{ServerName: sni}, p.ID)
+	if p.Spec != nil {
+		if err := uconn.ApplyPreset(p.Spec()); err != nil {
+			return nil, -1, err
+		}
+	}
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return nil, -1, err
+	}
+
+	// the padding extension is not sent at all when no padding is needed, so
+	// find where it would be from the extensions that are sent
+	padIndex = -1
+	n := 0
+	for _, ext := range uconn.Extensions {
+		if _, ok := ext.(*tls.UtlsPaddingExtension); ok {
+			padIndex = n
+		} else if ext.Len() > 0 {
+			n++
+		}
+	}
+
+	go func() {
+		uconn.Handshake()
+	}()
+
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(server, hdr); err != nil {
+		return nil, -1, err
+	}
+	record = make([]byte, 5+int(binary.BigEndian.Uint16(hdr[3:])))
+	copy(record, hdr)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		return nil, -1, err
+	}
+
+	return record, padIndex, nil
+}
+
+// Template is the ClientHello record of a profile, sent for the server name
+// "client-hello-gen.invalid". Probes parse it and fill in the server name and
+// the per connection fields (random, session ID, key shares, GREASE ECH) with
+// the same ClientHello builder they use for their own ClientHellos.
+type Template struct {
+	Name  string `json:"name"`
+	Hello []byte `json:"hello"`
+
+	// Padding is whether the profile pads the ClientHello BoringSSL style,
+	// in which case the padding extension is recomputed for each server name.
+	Padding bool `json:"padding"`
+}
+
+// NewTemplate generates the ClientHello of profile.
+func NewTemplate(profile string) (*Template, error) {
+	record, padIndex, err := Generate(profile, "client-hello-gen.invalid")
+	if err != nil {
+		return nil, err
+	}
+	return &Template{Name: profile, Hello: record, Padding: padIndex >= 0}, nil
+}
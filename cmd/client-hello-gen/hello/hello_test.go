@@ -0,0 +1,126 @@
+package hello
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"testing"
+)
+
+const (
+	extServerName = 0x0000
+	extPadding    = 0x0015
+	extKeyShare   = 0x0033
+)
+
+// extensions returns the extensions of the ClientHello record b in order,
+// failing if any of the lengths are inconsistent.
+func extensions(t *testing.T, b []byte) [][]byte {
+	t.Helper()
+	if len(b) < 44 || int(binary.BigEndian.Uint16(b[3:])) != len(b)-5 {
+		t.Fatalf("bad record length")
+	}
+	if int(b[6])<<16|int(b[7])<<8|int(b[8]) != len(b)-9 {
+		t.Fatalf("bad handshake length")
+	}
+
+	// record header (5), handshake header (4), version (2), random (32)
+	pos := 43
+	pos += 1 + int(b[pos])
+	pos += 2 + int(binary.BigEndian.Uint16(b[pos:]))
+	pos += 1 + int(b[pos])
+	if pos+2 > len(b) || int(binary.BigEndian.Uint16(b[pos:])) != len(b)-pos-2 {
+		t.Fatalf("bad extensions length")
+	}
+
+	var exts [][]byte
+	for pos += 2; pos < len(b); {
+		if pos+4 > len(b) {
+			t.Fatalf("bad extension header")
+		}
+		n := 4 + int(binary.BigEndian.Uint16(b[pos+2:]))
+		if pos+n > len(b) {
+			t.Fatalf("bad extension length")
+		}
+		exts = append(exts, b[pos:pos+n])
+		pos += n
+	}
+	return exts
+}
+
+func extensionType(ext []byte) int {
+	return int(binary.BigEndian.Uint16(ext))
+}
+
+func TestNames(t *testing.T) {
+	names := Names()
+	if len(names) != len(Profiles) || !sort.StringsAreSorted(names) {
+		t.Fatalf("bad names %v", names)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	for _, name := range Names() {
+		record, padIndex, err := Generate(name, "example.com")
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		var sni, keyShare bool
+		for i, ext := range extensions(t, record) {
+			switch extensionType(ext) {
+			case extServerName:
+				sni = bytes.HasSuffix(ext, []byte("\x00\x0bexample.com"))
+			case extKeyShare:
+				keyShare = true
+			case extPadding:
+				if i != padIndex {
+					t.Errorf("%s: padding is extension %d not %d", name, i, padIndex)
+				}
+			}
+		}
+		if !sni || !keyShare {
+			t.Errorf("%s: missing server name or key share", name)
+		}
+	}
+
+	if _, _, err := Generate("netscape", "example.com"); err == nil {
+		t.Errorf("unknown profile generated")
+	}
+}
+
+func TestNewTemplate(t *testing.T) {
+	pads := map[string]bool{"chrome-legacy": true, "safari": true}
+	for _, name := range Names() {
+		tmpl, err := NewTemplate(name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if tmpl.Name != name || tmpl.Padding != pads[name] {
+			t.Errorf("%s: bad template %s padding %t", name, tmpl.Name, tmpl.Padding)
+		}
+
+		var sni bool
+		for _, ext := range extensions(t, tmpl.Hello) {
+			if extensionType(ext) == extServerName {
+				sni = bytes.HasSuffix(ext, []byte("client-hello-gen.invalid"))
+			}
+		}
+		if !sni {
+			t.Errorf("%s: missing placeholder server name", name)
+		}
+
+		// the random is new for each template
+		again, err := NewTemplate(name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if bytes.Equal(tmpl.Hello[11:43], again.Hello[11:43]) {
+			t.Errorf("%s: random repeated", name)
+		}
+	}
+
+	if _, err := NewTemplate("netscape"); err == nil {
+		t.Errorf("unknown profile template")
+	}
+}
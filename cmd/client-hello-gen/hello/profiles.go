@@ -0,0 +1,194 @@
+package hello
+
+import (
+	tls "github.com/refraction-networking/utls"
+)
+
+// Profiles maps profile names to the uTLS ClientHello they are generated
+// from. Profiles with a nil spec use the uTLS preset for the ID.
+var Profiles = map[string]struct {
+	ID   tls.ClientHelloID
+	Spec func() *tls.ClientHelloSpec
+}{
+	"chrome":        {tls.HelloChrome_Auto, nil},
+	"chrome-legacy": {tls.HelloCustom, chromeLegacySpec},
+	"firefox":       {tls.HelloFirefox_Auto, nil},
+	"safari":        {tls.HelloSafari_Auto, nil},
+	"go":            {tls.HelloGolang, nil},
+	"curl":          {tls.HelloCustom, curlSpec},
+}
+
+// chromeLegacySpec is a Chrome 7x ClientHello.
+func chromeLegacySpec() *tls.ClientHelloSpec {
+	return &tls.ClientHelloSpec{
+		CipherSuites: []uint16{
+			tls.GREASE_PLACEHOLDER,
+			tls.TLS_AES_128_GCM_SHA256,
+			tls.TLS_AES_256_GCM_SHA384,
+			tls.TLS_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		},
+		CompressionMethods: []byte{
+			0x00, // compressionNone
+		},
+		Extensions: []tls.TLSExtension{
+			&tls.UtlsGREASEExtension{},
+			&tls.SNIExtension{},
+			&tls.UtlsExtendedMasterSecretExtension{},
+			&tls.RenegotiationInfoExtension{Renegotiation: tls.RenegotiateOnceAsClient},
+			&tls.SupportedCurvesExtension{Curves: []tls.CurveID{
+				tls.CurveID(tls.GREASE_PLACEHOLDER),
+				tls.X25519,
+				tls.CurveP256,
+				tls.CurveP384,
+			}},
+			&tls.SupportedPointsExtension{SupportedPoints: []byte{
+				0x00, // pointFormatUncompressed
+			}},
+			&tls.SessionTicketExtension{},
+			&tls.ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}},
+			&tls.StatusRequestExtension{},
+			&tls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []tls.SignatureScheme{
+				tls.ECDSAWithP256AndSHA256,
+				tls.PSSWithSHA256,
+				tls.PKCS1WithSHA256,
+				tls.ECDSAWithP384AndSHA384,
+				tls.PSSWithSHA384,
+				tls.PKCS1WithSHA384,
+				tls.PSSWithSHA512,
+				tls.PKCS1WithSHA512,
+			}},
+			&tls.SCTExtension{},
+			&tls.KeyShareExtension{KeyShares: []tls.KeyShare{
+				{Group: tls.CurveID(tls.GREASE_PLACEHOLDER), Data: []byte{0}},
+				{Group: tls.X25519},
+			}},
+			&tls.PSKKeyExchangeModesExtension{Modes: []uint8{
+				tls.PskModeDHE,
+			}},
+			&tls.SupportedVersionsExtension{Versions: []uint16{
+				tls.GREASE_PLACEHOLDER,
+				tls.VersionTLS13,
+				tls.VersionTLS12,
+			}},
+			&tls.UtlsCompressCertExtension{},
+			&tls.GenericExtension{Id: 0x4469}, // WARNING: UNKNOWN EXTENSION, USE AT YOUR OWN RISK
+			&tls.UtlsGREASEExtension{},
+			&tls.UtlsPaddingExtension{GetPaddingLen: tls.BoringPaddingStyle},
+		},
+	}
+}
+
+// curlSpec is curl 8 built against OpenSSL 3 with default options.
+func curlSpec() *tls.ClientHelloSpec {
+	return &tls.ClientHelloSpec{
+		TLSVersMax: tls.VersionTLS13,
+		TLSVersMin: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_AES_256_GCM_SHA384,
+			tls.TLS_CHACHA20_POLY1305_SHA256,
+			tls.TLS_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			0x009f, // TLS_DHE_RSA_WITH_AES_256_GCM_SHA384
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			0xccaa, // TLS_DHE_RSA_WITH_CHACHA20_POLY1305_SHA256
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.FAKE_TLS_DHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.DISABLED_TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA384,
+			tls.DISABLED_TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA384,
+			tls.FAKE_TLS_DHE_RSA_WITH_AES_256_CBC_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+			tls.FAKE_TLS_DHE_RSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.FAKE_TLS_DHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.FAKE_TLS_DHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.DISABLED_TLS_RSA_WITH_AES_256_CBC_SHA256,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.FAKE_TLS_EMPTY_RENEGOTIATION_INFO_SCSV,
+		},
+		CompressionMethods: []byte{
+			0x00, // compressionNone
+		},
+		Extensions: []tls.TLSExtension{
+			&tls.SNIExtension{},
+			&tls.SupportedPointsExtension{SupportedPoints: []byte{
+				0x00, // pointFormatUncompressed
+				0x01, // ansiX962_compressed_prime
+				0x02, // ansiX962_compressed_char2
+			}},
+			&tls.SupportedCurvesExtension{Curves: []tls.CurveID{
+				tls.X25519,
+				tls.CurveP256,
+				tls.CurveID(0x001e), // x448
+				tls.CurveP521,
+				tls.CurveP384,
+				tls.CurveID(0x0100), // ffdhe2048
+				tls.CurveID(0x0101), // ffdhe3072
+				tls.CurveID(0x0102), // ffdhe4096
+				tls.CurveID(0x0103), // ffdhe6144
+				tls.CurveID(0x0104), // ffdhe8192
+			}},
+			&tls.SessionTicketExtension{},
+			&tls.ALPNExtension{AlpnProtocols: []string{"h2", "http/1.1"}},
+			&tls.GenericExtension{Id: 0x0016}, // encrypt_then_mac
+			&tls.UtlsExtendedMasterSecretExtension{},
+			&tls.SignatureAlgorithmsExtension{SupportedSignatureAlgorithms: []tls.SignatureScheme{
+				tls.ECDSAWithP256AndSHA256,
+				tls.ECDSAWithP384AndSHA384,
+				tls.ECDSAWithP521AndSHA512,
+				tls.Ed25519,
+				tls.SignatureScheme(0x0808), // ed448
+				tls.SignatureScheme(0x081a), // ecdsa_brainpoolP256r1tls13_sha256
+				tls.SignatureScheme(0x081b), // ecdsa_brainpoolP384r1tls13_sha384
+				tls.SignatureScheme(0x081c), // ecdsa_brainpoolP512r1tls13_sha512
+				tls.PSSWithSHA256,
+				tls.PSSWithSHA384,
+				tls.PSSWithSHA512,
+				tls.SignatureScheme(0x0809), // rsa_pss_pss_sha256
+				tls.SignatureScheme(0x080a), // rsa_pss_pss_sha384
+				tls.SignatureScheme(0x080b), // rsa_pss_pss_sha512
+				tls.PKCS1WithSHA256,
+				tls.PKCS1WithSHA384,
+				tls.PKCS1WithSHA512,
+				tls.SignatureScheme(0x0303), // ecdsa_sha224
+				tls.SignatureScheme(0x0301), // rsa_pkcs1_sha224
+				tls.SignatureScheme(0x0302), // dsa_sha224
+				tls.SignatureScheme(0x0402), // dsa_sha256
+				tls.SignatureScheme(0x0502), // dsa_sha384
+				tls.SignatureScheme(0x0602), // dsa_sha512
+			}},
+			&tls.SupportedVersionsExtension{Versions: []uint16{
+				tls.VersionTLS13,
+				tls.VersionTLS12,
+			}},
+			&tls.PSKKeyExchangeModesExtension{Modes: []uint8{
+				tls.PskModeDHE,
+			}},
+			&tls.KeyShareExtension{KeyShares: []tls.KeyShare{
+				{Group: tls.X25519},
+			}},
+		},
+	}
+}
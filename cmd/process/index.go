@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapSegment describes a single pcap file in a pcapIndex.
+type pcapSegment struct {
+	File    string    `json:"file"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Packets int64     `json:"packets"`
+}
+
+// pcapIndex lists the segments of a rotated pcap written by bidi with
+// -pcap-rotate-size or -pcap-rotate-interval. Segment files are relative to
+// the index.
+type pcapIndex struct {
+	Segments []pcapSegment `json:"segments"`
+}
+
+// readPackets calls handle for each packet in the pcap (.pcap or .pcap.gz) at
+// path. If path is a pcap index (.json) the packets of every segment are read
+// in order.
+func readPackets(path string, handle func(gopacket.Packet)) error {
+	if !strings.HasSuffix(path, ".json") {
+		return readPcap(path, handle)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var index pcapIndex
+	err = json.Unmarshal(content, &index)
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range index.Segments {
+		err = readPcap(filepath.Join(filepath.Dir(path), segment.File), handle)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPcap(path string, handle func(gopacket.Packet)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	packetSource := gopacket.NewPacketSource(r, r.LinkType()) // construct using pcap or pfring
+	for packet := range packetSource.Packets() {
+		handle(packet)
+	}
+	return nil
+}
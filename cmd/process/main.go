@@ -1,5 +1,6 @@
 /*
-Allows use of .pcap or .pcap.gz for input
+Allows use of .pcap or .pcap.gz for input, or a pcap index (.index.json)
+listing rotated pcap segments.
 
 see:
 - https://github.com/google/gopacket/pull/214
@@ -9,6 +10,7 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
 	"sort"
@@ -16,7 +18,6 @@ import (
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcapgo"
 )
 
 var controlDomains = []string{
@@ -42,12 +43,24 @@ type PacketDetails struct {
 type Probe struct {
 	Target string
 	Domain string
+	// Local is the local (source) address the probe was sent from, which is
+	// the destination address of the response.
+	Local string
 }
 
 func (p *Probe) String() string {
 	return fmt.Sprintf("%s@%s", p.Target, p.Domain)
 }
 
+// key returns the key packets of the probe are grouped by, the probe with
+// the local address appended ("target@domain/local") if byLocal is set.
+func (p *Probe) key(byLocal bool) string {
+	if byLocal {
+		return p.String() + "/" + p.Local
+	}
+	return p.String()
+}
+
 // Data tracks all data about received packets
 type Data struct {
 	NonZeroPackets        []*PacketDetails
@@ -57,6 +70,10 @@ type Data struct {
 	ControlPacketsByProbe map[string][]*PacketDetails
 	UnknownPackets        []*PacketDetails
 	UnknownPacketsByProbe map[string][]*PacketDetails
+
+	// byLocal keys the packets by probe also by the local address the probe
+	// was sent from (see Probe.key).
+	byLocal bool
 }
 
 func getU8F(packets []*PacketDetails, f u8f, exclude packetFilter) []uint8 {
@@ -153,6 +170,24 @@ func (d *Data) printStats() error {
 	return nil
 }
 
+// printResponseRates prints the number of responses received for each probe
+// and the mean number of responses per send when every probe was sent repeat
+// times (see the bidi -repeat option). Probes that are consistently answered
+// have a rate that is stable across probes, while lost probes or responses
+// show as rates below that of similar probes.
+func (d *Data) printResponseRates(repeat int) {
+	keys := make([]string, 0, len(d.PacketsByProbe))
+	for k := range d.PacketsByProbe {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		n := len(d.PacketsByProbe[k])
+		fmt.Printf("%s %d %d %f\n", k, n, repeat, float64(n)/float64(repeat))
+	}
+}
+
 func handlePacket(d *Data, dkt *KeyTable, packet gopacket.Packet) {
 
 	p := &Probe{}
@@ -161,6 +196,7 @@ func handlePacket(d *Data, dkt *KeyTable, packet gopacket.Packet) {
 	if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
 		ip, _ := ipLayer.(*layers.IPv4)
 		p.Target = ip.SrcIP.String()
+		p.Local = ip.DstIP.String()
 		details.IpTTL = ip.TTL
 		details.IpID = ip.Id
 		details.TcpFlags = ip.Payload[13] & 0x3F
@@ -169,6 +205,7 @@ func handlePacket(d *Data, dkt *KeyTable, packet gopacket.Packet) {
 	} else if ipLayer := packet.Layer(layers.LayerTypeIPv6); ipLayer != nil {
 		ip, _ := ipLayer.(*layers.IPv6)
 		p.Target = ip.SrcIP.String()
+		p.Local = ip.DstIP.String()
 		details.IpTTL = ip.HopLimit
 		details.IpID = 0
 		details.TcpFlags = ip.Payload[13] & 0x3F
@@ -197,7 +234,7 @@ func handlePacket(d *Data, dkt *KeyTable, packet gopacket.Packet) {
 	}
 
 	// fmt.Printf("%s:%s\n", p.Target, p.Domain)
-	ps := p.String()
+	ps := p.key(d.byLocal)
 
 	if p.Domain == "UNKNOWN" {
 		d.UnknownPackets = append(d.UnknownPackets, details)
@@ -239,10 +276,27 @@ func main() {
 		UnknownPacketsByProbe: make(map[string][]*PacketDetails),
 	}
 
+	sentPath := flag.String("sent", "", "sent packet pcap (bidi -record-sent) to correlate with the responses")
+	byLocal := flag.Bool("by-local", false, "key probes by the local address they were sent from as well as the target and domain (target@domain/local), for bidi -laddr lists and ranges")
+	repeat := flag.Int("repeat", 0, "number of times each probe was sent (bidi -repeat). If set the number of responses per probe and per send is printed")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <pcap> <dkt.json>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	data.byLocal = *byLocal
+
+	if *repeat < 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "bad repeat count %d - must not be negative\n", *repeat)
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	var pcapPath, dktPath string
-	if len(os.Args[1:]) > 1 {
-		pcapPath = os.Args[1]
-		dktPath = os.Args[2]
+	if len(flag.Args()) > 1 {
+		pcapPath = flag.Arg(0)
+		dktPath = flag.Arg(1)
 	} else {
 		panic("not enough file paths provided")
 	}
@@ -252,29 +306,25 @@ func main() {
 		panic(err)
 	}
 
-	f, err := os.Open(pcapPath)
-
+	err = readPackets(pcapPath, func(packet gopacket.Packet) {
+		handlePacket(data, dkt, packet)
+	})
 	if err != nil {
-		panic("could not open file")
+		panic(err)
 	}
 
-	defer f.Close()
-
-	r, err := pcapgo.NewReader(f)
-
-	if err != nil {
-		panic("error reading pcap")
+	if *sentPath != "" {
+		sent, err := readSent(*sentPath, dkt, *byLocal)
+		if err != nil {
+			panic(err)
+		}
+		data.printSentAndResponses(sent)
+		return
 	}
 
-	// packetCount := 0
-	packetSource := gopacket.NewPacketSource(r, r.LinkType()) // construct using pcap or pfring
-	for packet := range packetSource.Packets() {
-
-		handlePacket(data, dkt, packet)
-		// packetCount += 1 // do something with each packet
-		// if packetCount > 1000 {
-		// 	break
-		// }
+	if *repeat > 0 {
+		data.printResponseRates(*repeat)
+		return
 	}
 
 	// err = data.PrintStats()
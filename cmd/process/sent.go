@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// readSent counts the packets sent for each probe in a sent packet pcap or
+// pcap index (written by bidi with -record-sent). Probes are keyed the same
+// way as the responses in Data.PacketsByProbe.
+func readSent(pcapPath string, dkt *KeyTable, byLocal bool) (map[string]int, error) {
+	sent := make(map[string]int)
+	err := readPackets(pcapPath, func(packet gopacket.Packet) {
+		p := &Probe{}
+		if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+			ip, _ := ipLayer.(*layers.IPv4)
+			p.Target = ip.DstIP.String()
+			p.Local = ip.SrcIP.String()
+		} else if ipLayer := packet.Layer(layers.LayerTypeIPv6); ipLayer != nil {
+			ip, _ := ipLayer.(*layers.IPv6)
+			p.Target = ip.DstIP.String()
+			p.Local = ip.SrcIP.String()
+		} else {
+			return
+		}
+
+		var sport uint16
+		if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+			tcp, _ := tcpLayer.(*layers.TCP)
+			sport = uint16(tcp.SrcPort)
+		} else if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
+			udp, _ := udpLayer.(*layers.UDP)
+			sport = uint16(udp.SrcPort)
+		} else {
+			// non-first IP fragments carry no transport header
+			return
+		}
+
+		if d, ok := dkt.R[sport]; ok {
+			p.Domain = d
+		} else {
+			p.Domain = "UNKNOWN"
+		}
+		sent[p.key(byLocal)]++
+	})
+
+	return sent, err
+}
+
+// printSentAndResponses prints the number of packets sent and responses
+// received for each probe.
+func (d *Data) printSentAndResponses(sent map[string]int) {
+	keys := make([]string, 0, len(sent))
+	for k := range sent {
+		keys = append(keys, k)
+	}
+	for k := range d.PacketsByProbe {
+		if _, ok := sent[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Println(k, sent[k], len(d.PacketsByProbe[k]))
+	}
+}